@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bitcoinfees/feesim/api"
+)
+
+// feesimAPI is the part of the feesim API used by the profile, mining and
+// scores plots.
+type feesimAPI interface {
+	Scores(ctx context.Context) (map[string][]float64, error)
+	BlockSource(ctx context.Context) (map[string]interface{}, error)
+	TxRate(ctx context.Context, n int) (map[string][]float64, error)
+	CapRate(ctx context.Context, n int) (map[string][]float64, error)
+	MempoolSize(ctx context.Context, n int) (map[string][]float64, error)
+	EstimateFee(ctx context.Context, n int) (interface{}, error)
+}
+
+// feesimClient wraps api.Client, whose calls can't be cancelled, so that
+// callers can stop waiting on them once their context is done.
+type feesimClient struct {
+	c *api.Client
+}
+
+func newFeesimClient(host, port string) *feesimClient {
+	return &feesimClient{api.NewClient(api.Config{Host: host, Port: port, Timeout: 15})}
+}
+
+// call runs f in its own goroutine, returning when f does or when ctx is
+// done, whichever is first.
+func (c *feesimClient) call(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// The goroutine is outside the job's recover boundary.
+		defer func() {
+			if r := recover(); r != nil {
+				errc <- recovered(ctx, r)
+			}
+		}()
+		errc <- f()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *feesimClient) Scores(ctx context.Context) (map[string][]float64, error) {
+	var r map[string][]float64
+	if err := c.call(ctx, func() (err error) { r, err = c.c.Scores(); return }); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *feesimClient) BlockSource(ctx context.Context) (map[string]interface{}, error) {
+	var r map[string]interface{}
+	if err := c.call(ctx, func() (err error) { r, err = c.c.BlockSource(); return }); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *feesimClient) TxRate(ctx context.Context, n int) (map[string][]float64, error) {
+	var r map[string][]float64
+	if err := c.call(ctx, func() (err error) { r, err = c.c.TxRate(n); return }); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *feesimClient) CapRate(ctx context.Context, n int) (map[string][]float64, error) {
+	var r map[string][]float64
+	if err := c.call(ctx, func() (err error) { r, err = c.c.CapRate(n); return }); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *feesimClient) MempoolSize(ctx context.Context, n int) (map[string][]float64, error) {
+	var r map[string][]float64
+	if err := c.call(ctx, func() (err error) { r, err = c.c.MempoolSize(n); return }); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *feesimClient) EstimateFee(ctx context.Context, n int) (interface{}, error) {
+	var r interface{}
+	if err := c.call(ctx, func() (err error) { r, err = c.c.EstimateFee(n); return }); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// hashStore keeps the hash of the last payload successfully put to each
+// worksheet of each sink target, persisted as JSON so that it survives
+// restarts.
+type hashStore struct {
+	path string
+
+	mu     sync.Mutex
+	hashes map[string]map[string]string // by sinkTarget, then worksheet
+}
+
+var hashStores = struct {
+	sync.Mutex
+	m map[string]*hashStore
+}{m: make(map[string]*hashStore)}
+
+// openHashStore returns the hashStore persisted in path, which need not
+// exist yet. Stores are shared between sinks.
+func openHashStore(path string) (*hashStore, error) {
+	hashStores.Lock()
+	defer hashStores.Unlock()
+	if h, ok := hashStores.m[path]; ok {
+		return h, nil
+	}
+	h := &hashStore{path: path, hashes: make(map[string]map[string]string)}
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &h.hashes); err != nil {
+			return nil, fmt.Errorf("Reading upload hashes %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	hashStores.m[path] = h
+	return h, nil
+}
+
+func (h *hashStore) get(target, worksheet string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hashes[target][worksheet]
+}
+
+// set records the hash for the worksheet, or forgets it if hash is empty,
+// and saves the store.
+func (h *hashStore) set(target, worksheet, hash string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hashes[target][worksheet] == hash {
+		return nil
+	}
+	if hash == "" {
+		delete(h.hashes[target], worksheet)
+	} else {
+		if h.hashes[target] == nil {
+			h.hashes[target] = make(map[string]string)
+		}
+		h.hashes[target][worksheet] = hash
+	}
+	b, err := json.MarshalIndent(h.hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.path, b)
+}
+
+// dedupSink skips Puts of payloads identical to the last one successfully
+// put to the worksheet. Timestr worksheets are always put, without saving
+// their hashes, since they change on every run.
+type dedupSink struct {
+	Sink
+	target string
+	store  *hashStore
+}
+
+func (s *dedupSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	if isTimestr(csv) {
+		return s.Sink.Put(ctx, worksheet, csv)
+	}
+	sum := sha256.Sum256(csv)
+	hash := hex.EncodeToString(sum[:])
+	if s.store.get(s.target, worksheet) == hash {
+		uploadsSkipped.Inc(worksheet)
+		return nil
+	}
+	err := s.Sink.Put(ctx, worksheet, csv)
+	// After a failure the worksheet's content is unknown, e.g. an older
+	// payload might be replayed from the spool, so forget the hash.
+	if err != nil {
+		hash = ""
+	}
+	if serr := s.store.set(s.target, worksheet, hash); serr != nil {
+		loggerFrom(ctx).Printf("[ERROR] Saving upload hashes: %v", serr)
+	}
+	return err
+}
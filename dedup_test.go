@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reopenHashStore drops the store in path from the registry and opens it
+// again, as after a restart.
+func reopenHashStore(t *testing.T, path string) *hashStore {
+	t.Helper()
+	hashStores.Lock()
+	delete(hashStores.m, path)
+	hashStores.Unlock()
+	h, err := openHashStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestDedupSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	rs := newRecordingSink()
+	s := &dedupSink{rs, "putsheet ID", reopenHashStore(t, path)}
+	ctx := context.Background()
+	put := func(csv string, wantPuts int) {
+		t.Helper()
+		if err := s.Put(ctx, "1m", []byte(csv)); err != nil && rs.err == nil {
+			t.Fatal(err)
+		}
+		if rs.puts != wantPuts {
+			t.Fatalf("%d puts after putting %q, want %d.", rs.puts, csv, wantPuts)
+		}
+	}
+
+	put("a\n", 1)
+	put("a\n", 1) // unchanged, skipped
+	put("b\n", 2)
+
+	// Persisted across restarts.
+	s.store = reopenHashStore(t, path)
+	put("b\n", 2)
+
+	// After a failure the hash is forgotten, so the same payload is put
+	// again, even after a restart.
+	rs.err = errors.New("Sink down.")
+	put("c\n", 3)
+	rs.err = nil
+	s.store = reopenHashStore(t, path)
+	put("b\n", 4)
+	put("b\n", 4)
+
+	// Another spec has its own hashes.
+	if err := (&dedupSink{rs, "dir:/plots", s.store}).Put(ctx, "1m", []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if rs.puts != 5 {
+		t.Errorf("Put to another spec skipped.")
+	}
+
+	// So does another spreadsheet with the same spec.
+	for _, tc := range []struct {
+		spreadsheet string
+		wantPuts    int
+	}{
+		{"ID", 5},
+		{"ID2", 6},
+		{"ID2", 6},
+	} {
+		cfg := sinkConfig{spreadsheet: tc.spreadsheet, dedup: path}
+		us, err := uploadSink("putsheet", rs, cfg, retryPolicy{Attempts: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := us.Put(ctx, "1m", []byte("b\n")); err != nil {
+			t.Fatal(err)
+		}
+		if rs.puts != tc.wantPuts {
+			t.Errorf("%d puts after putting to spreadsheet %s, want %d.", rs.puts, tc.spreadsheet, tc.wantPuts)
+		}
+	}
+}
+
+func TestDedupSinkTimestr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	rs := newRecordingSink()
+	s := &dedupSink{rs, "putsheet", reopenHashStore(t, path)}
+	for i := 0; i < 2; i++ {
+		if err := s.Put(context.Background(), "profile_time", timestrSheet("profile_time", time.Now()).csv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rs.puts != 2 {
+		t.Errorf("%d timestr puts, want 2.", rs.puts)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Hash file written for timestr worksheets: %v", err)
+	}
+}
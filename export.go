@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ziutek/rrd"
+)
+
+// rraInfo describes a round robin archive of an RRD file.
+type rraInfo struct {
+	index int
+	cf    string
+	step  int64 // in seconds
+	rows  int64
+}
+
+// rrdArchives returns the archives of rrdfile, along with the time of its
+// last update.
+func rrdArchives(rrdfile string) ([]rraInfo, time.Time, error) {
+	inf, err := rrd.Info(rrdfile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	step, ok := inf["step"].(uint)
+	if !ok {
+		return nil, time.Time{}, errors.New("No step in RRD info.")
+	}
+	lastUpdate, ok := inf["last_update"].(uint)
+	if !ok {
+		return nil, time.Time{}, errors.New("No last_update in RRD info.")
+	}
+	cfs, _ := inf["rra.cf"].([]interface{})
+	pdps, _ := inf["rra.pdp_per_row"].([]interface{})
+	rows, _ := inf["rra.rows"].([]interface{})
+	if len(cfs) == 0 || len(cfs) != len(pdps) || len(cfs) != len(rows) {
+		return nil, time.Time{}, errors.New("Invalid RRA info.")
+	}
+
+	rras := make([]rraInfo, len(cfs))
+	for i := range rras {
+		cf, ok1 := cfs[i].(string)
+		pdp, ok2 := pdps[i].(uint)
+		n, ok3 := rows[i].(uint)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, time.Time{}, fmt.Errorf("Invalid info for RRA %d.", i)
+		}
+		rras[i] = rraInfo{
+			index: i,
+			cf:    cf,
+			step:  int64(step) * int64(pdp),
+			rows:  int64(n),
+		}
+	}
+	return rras, time.Unix(int64(lastUpdate), 0), nil
+}
+
+// exportRRA writes the values in the given archive between start and end
+// to w, as one (time, ds, value) record per line. Unknown values are
+// skipped. Zero start or end times default to the archive's full range.
+func exportRRA(w io.Writer, rrdfile string, rra rraInfo, lastUpdate, start, end time.Time, format string) error {
+	step := time.Duration(rra.step) * time.Second
+	last := lastUpdate.Unix() - lastUpdate.Unix()%rra.step
+	first := last - (rra.rows-1)*rra.step
+	if start.IsZero() || start.Unix() < first {
+		start = time.Unix(first, 0)
+	}
+	if end.IsZero() || end.Unix() > last {
+		end = time.Unix(last, 0)
+	}
+	if !end.After(start) {
+		return nil
+	}
+
+	// Fetch returns the rows after start, so step back one row.
+	f, err := rrd.Fetch(rrdfile, rra.cf, start.Add(-step), end, step)
+	if err != nil {
+		return err
+	}
+	defer f.FreeValues()
+	if f.Step != step {
+		return fmt.Errorf("RRA %d: fetched step %v, expected %v.", rra.index, f.Step, step)
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	t := f.Start.Add(f.Step)
+	for i := 0; i < f.RowCnt-1; i, t = i+1, t.Add(f.Step) {
+		if t.Before(start) || t.After(end) {
+			continue
+		}
+		for j, ds := range f.DsNames {
+			v := f.ValueAt(j, i)
+			if math.IsNaN(v) {
+				continue
+			}
+			if format == "jsonl" {
+				rec := struct {
+					Time  int64   `json:"time"`
+					DS    string  `json:"ds"`
+					Value float64 `json:"value"`
+				}{t.Unix(), ds, v}
+				if err := enc.Encode(rec); err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintf(bw, "%d,%s,%s\n", t.Unix(), ds, strconv.FormatFloat(v, 'g', -1, 64))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// parseExportTime parses a unix timestamp or an RFC 3339 time. The empty
+// string is the zero time.
+func parseExportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(i, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func doExport(args []string) error {
+	var (
+		rrdfile    string
+		dir        string
+		format     string
+		start, end string
+	)
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.StringVar(&rrdfile, "f", "./rrd.db", "Path to RRD file.")
+	f.StringVar(&dir, "o", "", "Output directory.")
+	f.StringVar(&format, "t", "csv", "Output format, csv or jsonl.")
+	f.StringVar(&start, "start", "", "Start time, unix or RFC 3339; defaults to start of each RRA.")
+	f.StringVar(&end, "end", "", "End time, unix or RFC 3339; defaults to last update.")
+	if err := f.Parse(args[1:]); err != nil {
+		return err
+	}
+	if rrdfile == "" || dir == "" {
+		return errors.New("Insufficient args.")
+	}
+	if format != "csv" && format != "jsonl" {
+		return errors.New("Output format must be csv or jsonl.")
+	}
+	startTime, err := parseExportTime(start)
+	if err != nil {
+		return err
+	}
+	endTime, err := parseExportTime(end)
+	if err != nil {
+		return err
+	}
+
+	rras, lastUpdate, err := rrdArchives(rrdfile)
+	if err != nil {
+		return err
+	}
+	for _, rra := range rras {
+		// Write to a temp file and rename, as with writeFileAtomic, without
+		// holding the whole archive in memory.
+		name := filepath.Join(dir, fmt.Sprintf("rra%d_%s_%ds.%s", rra.index, rra.cf, rra.step, format))
+		tmp := name + ".tmp"
+		w, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		if format == "csv" {
+			fmt.Fprintln(w, "time,ds,value")
+		}
+		err = exportRRA(w, rrdfile, rra, lastUpdate, startTime, endTime, format)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("Exporting RRA %d: %v", rra.index, err)
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
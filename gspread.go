@@ -1,227 +1,163 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
-
-	"github.com/bitcoinfees/feesim/api"
 )
 
-func gspreadPutSheet(csv []byte, bin, spreadsheet, worksheet, auth string) (err error) {
-	const numtries = 3
-	var (
-		stdin  io.WriteCloser
-		stderr io.ReadCloser
-	)
-
-	for i := 0; i < numtries; i++ {
-		cmd := exec.Command(bin, spreadsheet, worksheet, auth)
-		stdin, err = cmd.StdinPipe()
-		if err != nil {
-			continue
-		}
-		stderr, err = cmd.StderrPipe()
-		if err != nil {
-			continue
-		}
-
-		go func() {
-			stdin.Write(csv)
-			stdin.Close()
-		}()
+// putsheetSink uploads worksheets by piping them to the putsheet script.
+type putsheetSink struct {
+	bin, spreadsheet, auth string
+}
 
-		sec := make(chan []byte)
-		go func() {
-			b, _ := ioutil.ReadAll(stderr)
-			sec <- b
-		}()
+func (s *putsheetSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	return gspreadPutSheet(ctx, csv, s.bin, s.spreadsheet, worksheet, s.auth)
+}
 
-		errc := make(chan error)
-		go func() { errc <- cmd.Run() }()
+// putsheetError is a failed run of putsheet, with what it wrote to stderr.
+type putsheetError struct {
+	err    error
+	stderr string
+}
 
-		toSigInt := time.NewTimer(time.Minute * 2)
-		toSigKill := time.NewTimer(time.Minute * 3)
+func (e *putsheetError) Error() string {
+	return fmt.Sprintf("%v: %s", e.err, e.stderr)
+}
 
-	WaitErr:
-		select {
-		case err = <-errc:
-			toSigInt.Stop()
-			toSigKill.Stop()
-			se := <-sec
-			if err == nil {
-				return
-			}
-			err = fmt.Errorf("%v: %s", err, string(se))
-		case <-toSigInt.C:
-			cmd.Process.Signal(os.Interrupt)
-			goto WaitErr
-		case <-toSigKill.C:
-			cmd.Process.Signal(os.Kill)
-			goto WaitErr
-		}
-	}
-	return
+// putsheetPermanent are markers in the stderr of putsheet of errors which
+// retrying won't fix.
+var putsheetPermanent = []string{
+	"Not enough input arguments.",
+	"No such file or directory",
+	"ValueError",
+	"SpreadsheetNotFound",
+	"WorksheetNotFound",
+	"invalid_grant",
 }
 
-func gspreadMainPlotter(rrdfile, bin, spreadsheet, auth string) mainPlotter {
-	plotMain := func(resnum int) error {
-		t := time.Now().Unix()
-		p, err := newMainPlot(t, rrdfile, resnum)
-		if err != nil {
-			return err
-		}
-		csv, err := p.CSV()
-		if err != nil {
-			return err
-		}
-		var worksheet string
-		switch resnum {
-		case res1:
-			worksheet = "1m"
-		case res30:
-			worksheet = "30m"
-		case res180:
-			worksheet = "3h"
-		case res1440:
-			worksheet = "1d"
-		default:
-			panic("Error should have been returned by newMainPlot.")
-		}
-		return gspreadPutSheet(csv, bin, spreadsheet, worksheet, auth)
+// putsheetKillGrace is how long putsheet is given to exit after being
+// interrupted because the run was cancelled, as on shutdown or at a job
+// deadline, rather than because its try timed out.
+const putsheetKillGrace = 5 * time.Second
+
+// putsheetGroups are the process groups of the running putsheets, so that
+// any left running can be killed on exit.
+var putsheetGroups = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+// killPutsheets kills the process groups of the running putsheets.
+func killPutsheets() {
+	putsheetGroups.Lock()
+	defer putsheetGroups.Unlock()
+	for pid := range putsheetGroups.pids {
+		syscall.Kill(-pid, syscall.SIGKILL)
 	}
-	return plotMain
 }
 
-func gspreadPutProfile(p *profilePlot, bin, spreadsheet, auth string) error {
-	conf, err := p.CSV("conf")
-	if err != nil {
-		return err
+// gspreadPutSheet runs putsheet once, in its own process group. If ctx is
+// done before it exits, the group is interrupted, and killed if putsheet
+// hasn't exited after the kill grace carried by ctx.
+func gspreadPutSheet(ctx context.Context, csv []byte, bin, spreadsheet, worksheet, auth string) error {
+	if _, err := os.Stat(auth); err != nil {
+		return permanent(err)
 	}
-	txrate, err := p.CSV("txrate")
+	cmd := exec.Command(bin, spreadsheet, worksheet, auth)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
 	}
-	caprate, err := p.CSV("caprate")
+	// stderr is read from a pipe of our own rather than cmd.StderrPipe,
+	// which Wait closes, possibly before it has been read.
+	stderr, stderrW, err := os.Pipe()
 	if err != nil {
 		return err
 	}
-	mempool, err := p.CSV("mempool")
+	defer stderr.Close()
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	stderrW.Close()
 	if err != nil {
-		return err
-	}
-
-	errc := make(chan error)
-	putAsync := func(csv []byte, worksheet string) {
-		errc <- gspreadPutSheet(csv, bin, spreadsheet, worksheet, auth)
-	}
-
-	timestr := []byte(fmt.Sprintf("timestr\n%s\n", time.Now().UTC().Format(time.RFC822)))
-
-	go putAsync(conf, "profile_conf")
-	go putAsync(txrate, "profile_txrate")
-	go putAsync(caprate, "profile_caprate")
-	go putAsync(mempool, "profile_mempool")
-	go putAsync(timestr, "profile_time")
-
-	var errGlobal error
-	for i := 0; i < 5; i++ {
-		if err := <-errc; err != nil {
-			errGlobal = err
-		}
-	}
-	return errGlobal
-}
-
-func gspreadProfilePlotter(host, port, bin, spreadsheet, auth string) func() error {
-	c := api.NewClient(api.Config{Host: host, Port: port, Timeout: 15})
-	plotProfile := func() error {
-		p, err := newProfilePlot(c)
-		if err != nil {
-			return err
+		if errors.Is(err, exec.ErrNotFound) || os.IsNotExist(err) || os.IsPermission(err) {
+			return permanent(err)
 		}
-		return gspreadPutProfile(p, bin, spreadsheet, auth)
-	}
-	return plotProfile
-}
-
-func gspreadPutMining(p *miningPlot, bin, spreadsheet, auth string) error {
-	mfr, err := p.CSV("mfr")
-	if err != nil {
-		return err
-	}
-	mbs, err := p.CSV("mbs")
-	if err != nil {
 		return err
 	}
+	pid := cmd.Process.Pid
+	putsheetGroups.Lock()
+	putsheetGroups.pids[pid] = true
+	putsheetGroups.Unlock()
+	defer func() {
+		putsheetGroups.Lock()
+		delete(putsheetGroups.pids, pid)
+		putsheetGroups.Unlock()
+	}()
+
+	go func() {
+		stdin.Write(csv)
+		stdin.Close()
+	}()
+
+	sec := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(stderr)
+		sec <- b
+	}()
 
 	errc := make(chan error)
-	putAsync := func(csv []byte, worksheet string) {
-		errc <- gspreadPutSheet(csv, bin, spreadsheet, worksheet, auth)
-	}
-
-	timestr := []byte(fmt.Sprintf("timestr\n%s\n", time.Now().UTC().Format(time.RFC822)))
-
-	go putAsync(mfr, "mining_mfr")
-	go putAsync(mbs, "mining_mbs")
-	go putAsync(timestr, "mining_time")
-
-	var errGlobal error
-	for i := 0; i < 3; i++ {
-		if err := <-errc; err != nil {
-			errGlobal = err
-		}
-	}
-	return errGlobal
-}
-
-func gspreadMiningPlotter(mfrCutoffProb float64, host, port, bin, spreadsheet, auth string) func() error {
-	c := api.NewClient(api.Config{Host: host, Port: port, Timeout: 15})
-	plotMining := func() error {
-		p, err := newMiningPlot(c, mfrCutoffProb)
-		if err != nil {
-			return err
+	go func() {
+		err := cmd.Wait()
+		// Don't wait on children of putsheet still holding stderr open.
+		stderr.SetReadDeadline(time.Now().Add(time.Second))
+		errc <- err
+	}()
+
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		syscall.Kill(-pid, syscall.SIGINT)
+		grace, parentDone := killGraceFrom(ctx)
+		killAt := time.Now().Add(grace)
+		toSigKill := time.NewTimer(grace)
+	Wait:
+		for {
+			select {
+			case err = <-errc:
+				break Wait
+			case <-parentDone:
+				// Cancelled during the grace of a timed out try.
+				parentDone = nil
+				if d := time.Until(killAt); d > putsheetKillGrace {
+					toSigKill.Stop()
+					toSigKill = time.NewTimer(putsheetKillGrace)
+				}
+			case <-toSigKill.C:
+				syscall.Kill(-pid, syscall.SIGKILL)
+				err = <-errc
+				break Wait
+			}
 		}
-		return gspreadPutMining(p, bin, spreadsheet, auth)
-	}
-	return plotMining
-}
-
-func gspreadPutScores(p *scoresPlot, bin, spreadsheet, auth string) error {
-	s, err := p.CSV()
-	if err != nil {
-		return err
-	}
-
-	errc := make(chan error)
-	putAsync := func(csv []byte, worksheet string) {
-		errc <- gspreadPutSheet(csv, bin, spreadsheet, worksheet, auth)
+		toSigKill.Stop()
 	}
-
-	timestr := []byte(fmt.Sprintf("timestr\n%s\n", time.Now().UTC().Format(time.RFC822)))
-	go putAsync(s, "predictscores")
-	go putAsync(timestr, "predictscores_time")
-
-	var errGlobal error
-	for i := 0; i < 2; i++ {
-		if err := <-errc; err != nil {
-			errGlobal = err
-		}
+	se := string(<-sec)
+	if err == nil {
+		return nil
 	}
-	return errGlobal
-}
-
-func gspreadScoresPlotter(host, port, bin, spreadsheet, auth string) func() error {
-	c := api.NewClient(api.Config{Host: host, Port: port, Timeout: 15})
-	plotScores := func() error {
-		p, err := newScoresPlot(c)
-		if err != nil {
-			return err
+	err = &putsheetError{err, se}
+	for _, marker := range putsheetPermanent {
+		if strings.Contains(se, marker) {
+			return permanent(err)
 		}
-		return gspreadPutScores(p, bin, spreadsheet, auth)
 	}
-	return plotScores
+	return err
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stubbornPutsheet writes a putsheet which ignores interrupts and starts a
+// child, whose pid it writes to a file.
+func stubbornPutsheet(t *testing.T) (bin, pidfile string) {
+	dir := t.TempDir()
+	bin = filepath.Join(dir, "putsheet")
+	pidfile = filepath.Join(dir, "pid")
+	script := "#!/bin/sh\ntrap '' INT\ncat > /dev/null\nsleep 60 &\necho $! > " + pidfile + "\nwait\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return bin, pidfile
+}
+
+// exited reports whether the process pid has exited, allowing for it to be
+// a zombie for a moment, or for longer if nothing reaps orphans.
+func exited(pid int) bool {
+	for i := 0; i < 10; i++ {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return true
+		}
+		if b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil {
+			if fields := strings.Fields(string(b)); len(fields) > 2 && fields[2] == "Z" {
+				return true
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPutsheetKillGrace(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration // of the try
+		cancel  time.Duration // of the Put
+		want    time.Duration // time to return, roughly
+	}{
+		{"timeout", 100 * time.Millisecond, 0, 100*time.Millisecond + time.Second},
+		{"cancelled", time.Minute, 100 * time.Millisecond, 100*time.Millisecond + putsheetKillGrace},
+		{"cancelled during grace", 100 * time.Millisecond, 500 * time.Millisecond, 500*time.Millisecond + putsheetKillGrace},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bin, pidfile := stubbornPutsheet(t)
+			policy := retryPolicy{Attempts: 1, Timeout: tc.timeout, KillGrace: time.Second}
+			if tc.cancel != 0 {
+				// Cancelling the Put cuts the grace short.
+				policy.KillGrace = time.Minute
+			}
+			s := &retrySink{&putsheetSink{bin: bin, spreadsheet: "s", auth: bin}, policy}
+			ctx := context.Background()
+			if tc.cancel != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.cancel)
+				defer cancel()
+			}
+			start := time.Now()
+			if err := s.Put(ctx, "w", []byte("a\n")); err == nil {
+				t.Fatal("No error from killed putsheet.")
+			}
+			if d := time.Since(start); d < tc.want-100*time.Millisecond || d > tc.want+time.Second {
+				t.Errorf("Put returned after %v, want about %v.", d, tc.want)
+			}
+
+			b, err := ioutil.ReadFile(pidfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exited(pid) {
+				t.Error("Child of putsheet still running.")
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobStatus is the run history of a loop job, as reported by the health
+// endpoints.
+type jobStatus struct {
+	Name        string     `json:"name"`
+	Period      int64      `json:"period"`
+	Offset      int64      `json:"offset"`
+	Started     time.Time  `json:"started"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Ready       bool       `json:"ready"`
+}
+
+// jobTracker records the status of the running loop jobs.
+type jobTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*jobStatus
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{jobs: make(map[string]*jobStatus)}
+}
+
+func (t *jobTracker) start(cfg loopConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jobs[cfg.Name] = &jobStatus{
+		Name:    cfg.Name,
+		Period:  cfg.Period,
+		Offset:  cfg.Offset,
+		Started: time.Now(),
+	}
+}
+
+func (t *jobTracker) remove(name string) {
+	t.mu.Lock()
+	delete(t.jobs, name)
+	t.mu.Unlock()
+}
+
+func (t *jobTracker) record(name string, attempt time.Time, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.jobs[name]
+	if !ok {
+		return
+	}
+	s.LastAttempt = &attempt
+	if err != nil {
+		s.LastError = err.Error()
+	} else {
+		now := time.Now()
+		s.LastSuccess = &now
+		s.LastError = ""
+	}
+}
+
+// status returns the job statuses sorted by name, and whether all jobs have
+// succeeded within maxPeriods of their periods. A job that hasn't yet
+// succeeded is allowed maxPeriods periods, plus its initial wait, from when
+// it started.
+func (t *jobTracker) status(now time.Time, maxPeriods int64) ([]jobStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ready := true
+	statuses := make([]jobStatus, 0, len(t.jobs))
+	for _, s := range t.jobs {
+		st := *s
+		since := st.Started.Add(time.Duration(st.Period+st.Offset) * time.Second)
+		if st.LastSuccess != nil {
+			since = *st.LastSuccess
+		}
+		st.Ready = now.Sub(since) <= time.Duration(maxPeriods*st.Period)*time.Second
+		ready = ready && st.Ready
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, ready
+}
+
+// healthHandler serves /healthz, which always succeeds while the process is
+// up, and /readyz, which fails if any job is stale.
+func (t *jobTracker) healthHandler(maxPeriods int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs, ready := t.status(time.Now(), maxPeriods)
+		code := http.StatusOK
+		if r.URL.Path == "/readyz" && !ready {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Ready bool        `json:"ready"`
+			Jobs  []jobStatus `json:"jobs"`
+		}{ready, jobs})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata/golden.")
+
+// fakeFeesim is a feesim API server which answers each method with the
+// result in testdata/api/<method>.json.
+type fakeFeesim struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	results map[string]json.RawMessage
+	fail    map[string]string   // error messages by method
+	calls   map[string][]string // params by method, JSON encoded
+}
+
+func newFakeFeesim(t *testing.T) *fakeFeesim {
+	t.Helper()
+	f := &fakeFeesim{
+		results: make(map[string]json.RawMessage),
+		fail:    make(map[string]string),
+		calls:   make(map[string][]string),
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "api", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		method := filepath.Base(file)
+		method = method[:len(method)-len(".json")]
+		f.results[method] = b
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeFeesim) serve(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		ID     interface{}     `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.calls[req.Method] = append(f.calls[req.Method], string(bytes.TrimSpace(req.Params)))
+	result, ok := f.results[req.Method]
+	msg := f.fail[req.Method]
+	f.mu.Unlock()
+
+	resp := map[string]interface{}{"id": req.ID, "result": nil, "error": nil}
+	switch {
+	case msg != "":
+		resp["error"] = map[string]interface{}{"code": -1, "message": msg}
+	case !ok:
+		resp["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	default:
+		resp["result"] = result
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// setResult replaces the result of method.
+func (f *fakeFeesim) setResult(method, result string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[method] = json.RawMessage(result)
+}
+
+// setError makes method fail with msg.
+func (f *fakeFeesim) setError(method, msg string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[method] = msg
+}
+
+func (f *fakeFeesim) params(method string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls[method]...)
+}
+
+// client returns a feesimClient for the server.
+func (f *fakeFeesim) client(t *testing.T) *feesimClient {
+	t.Helper()
+	host, port, err := net.SplitHostPort(f.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFeesimClient(host, port)
+}
+
+// recordingSink keeps the worksheets put to it in memory. Puts fail with
+// err if it is set.
+type recordingSink struct {
+	mu     sync.Mutex
+	sheets map[string][]byte
+	puts   int
+	err    error
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{sheets: make(map[string][]byte)}
+}
+
+func (s *recordingSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.puts++
+	if s.err != nil {
+		return s.err
+	}
+	s.sheets[worksheet] = append([]byte(nil), csv...)
+	return nil
+}
+
+func (s *recordingSink) get(worksheet string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.sheets[worksheet]
+	return b, ok
+}
+
+// checkGolden compares got with testdata/golden/<name>, rewriting the file
+// instead if -update is set.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	filename := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from golden file:\n got:\n%s\nwant:\n%s", name, got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFields are the fields attached to a log record. In the json format,
+// errors are written as their message and durations in seconds.
+type logFields map[string]interface{}
+
+// Logger writes log records either as text lines, like the standard
+// logger, or as JSON objects, one per line. Records carry the fields of
+// the Logger, which are only written in the json format; in the text
+// format the message is expected to say what matters.
+//
+// Messages starting with "[ERROR] " are logged at the error level.
+type Logger struct {
+	text   *log.Logger
+	w      io.Writer
+	mu     *sync.Mutex
+	fields logFields
+}
+
+// newLogger returns a Logger writing to w in the given format, text or
+// json.
+func newLogger(w io.Writer, format string) (*Logger, error) {
+	switch format {
+	case "text":
+		return &Logger{text: log.New(w, "", log.LstdFlags)}, nil
+	case "json":
+		return &Logger{w: w, mu: new(sync.Mutex)}, nil
+	default:
+		return nil, fmt.Errorf("Invalid log format %s.", format)
+	}
+}
+
+// With returns a Logger which adds fields to every record, overriding
+// fields of l with the same name.
+func (l *Logger) With(fields logFields) *Logger {
+	merged := make(logFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	c := *l
+	c.fields = merged
+	return &c
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	l.output(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Fatal logs v at the error level and exits.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.output("[ERROR] " + fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+func (l *Logger) output(msg string) {
+	if l.text != nil {
+		l.text.Output(3, msg)
+		return
+	}
+
+	record := make(map[string]interface{}, len(l.fields)+3)
+	for k, v := range l.fields {
+		switch v := v.(type) {
+		case nil:
+		case error:
+			record[k] = v.Error()
+		case time.Duration:
+			record[k] = v.Seconds()
+		default:
+			record[k] = v
+		}
+	}
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = "info"
+	if strings.HasPrefix(msg, "[ERROR] ") {
+		record["level"] = "error"
+		msg = strings.TrimPrefix(msg, "[ERROR] ")
+	}
+	record["msg"] = msg
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  record["time"],
+			"level": "error",
+			"msg":   fmt.Sprintf("Encoding log record: %v", err),
+		})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
+
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying l, for loggerFrom.
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// stderrLogger is used when a context carries no Logger.
+var stderrLogger, _ = newLogger(os.Stderr, "text")
+
+// loggerFrom returns the Logger carried by ctx.
+func loggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return stderrLogger
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loopConfig is a plotting job in the loop config file. Only Name and
+// Period are required; if Kind is empty, the job is derived from Name, which
+// can be one of the legacy plot names: 1m, 30m, 3h, 1d, render_1m,
+// render_30m, render_3h, render_1d, profile, mining or scores.
+type loopConfig struct {
+	Name   string `yaml:"name"`
+	Period int64  `yaml:"period"`
+	Offset int64  `yaml:"offset"`
+
+	// Overlap is what to do when a run is due while the previous one is
+	// still in progress: skip the run (the default), catch up by running
+	// once the previous run finishes, or run concurrently, up to
+	// MaxConcurrent runs. Runs taking longer than Deadline seconds, if
+	// non-zero, are cancelled.
+	Overlap       string `yaml:"overlap"`
+	MaxConcurrent int    `yaml:"maxconcurrent"`
+	Deadline      int64  `yaml:"deadline"`
+
+	// Retry overrides the global retry options for the job's uploads.
+	Retry retryPolicy `yaml:"retry"`
+
+	Kind      string              `yaml:"kind"`      // main, render, profile, mining or scores
+	Res       int64               `yaml:"res"`       // main/render: resolution in seconds
+	Length    int64               `yaml:"length"`    // main/render: window length in seconds
+	CF        cfList              `yaml:"cf"`        // main/render: consolidation functions
+	DS        map[string]dsConfig `yaml:"ds"`        // main: per data source conversion and format
+	Series    []seriesConfig      `yaml:"series"`    // main: derived series
+	Worksheet string              `yaml:"worksheet"` // target worksheet, or worksheet prefix
+	Sink      string              `yaml:"sink"`      // sink spec; defaults to -sink
+	MFRCutoff float64             `yaml:"mfrcutoff"` // mining: MFR cutoff prob
+	Undefined string              `yaml:"undefined"` // scores: written for undefined scores
+	CI        float64             `yaml:"ci"`        // scores: confidence level of interval columns
+
+	// Profile: numbers of points, rate unit and max conf target; see
+	// profileOptions.
+	TxRatePoints  int    `yaml:"txratepoints"`
+	CapRatePoints int    `yaml:"capratepoints"`
+	MempoolPoints int    `yaml:"mempoolpoints"`
+	RateUnit      string `yaml:"rateunit"`
+	MaxConf       int    `yaml:"maxconf"`
+
+	// Gaps is how the main plot's unknown values are written.
+	Gaps gapPolicy `yaml:"gaps"`
+}
+
+// setDefaults fills in the fields left empty in the config file, and
+// validates the result.
+func (c *loopConfig) setDefaults() error {
+	if c.Name == "" {
+		return errors.New("Loop config error: job without name.")
+	}
+	if c.Period <= 0 {
+		return fmt.Errorf("Loop config error: %s: period must be positive.", c.Name)
+	}
+
+	switch c.Overlap {
+	case "":
+		c.Overlap = "skip"
+	case "skip", "catchup":
+	case "concurrent":
+		if c.MaxConcurrent == 0 {
+			c.MaxConcurrent = 2
+		}
+	default:
+		return fmt.Errorf("Loop config error: %s: invalid overlap %s.", c.Name, c.Overlap)
+	}
+	if c.Overlap != "concurrent" {
+		c.MaxConcurrent = 1
+	}
+	if c.MaxConcurrent < 1 {
+		return fmt.Errorf("Loop config error: %s: maxconcurrent must be positive.", c.Name)
+	}
+	if c.Deadline < 0 {
+		return fmt.Errorf("Loop config error: %s: deadline must not be negative.", c.Name)
+	}
+	if err := c.Retry.validate(); err != nil {
+		return fmt.Errorf("Loop config error: %s: %v", c.Name, err)
+	}
+
+	preset := c.Name
+	if c.Kind == "" {
+		switch {
+		case resNumber(c.Name) != -1:
+			c.Kind = "main"
+		case strings.HasPrefix(c.Name, "render_"):
+			c.Kind = "render"
+			preset = strings.TrimPrefix(c.Name, "render_")
+		case c.Name == "profile", c.Name == "mining", c.Name == "scores":
+			c.Kind = c.Name
+		default:
+			return fmt.Errorf("Loop config error: invalid plot name %s.", c.Name)
+		}
+	}
+
+	switch c.Kind {
+	case "main", "render":
+		if c.Res == 0 || c.Length == 0 {
+			// Either can be overridden on its own for the legacy names.
+			spec, err := resSpec(resNumber(preset))
+			if err != nil {
+				return fmt.Errorf("Loop config error: %s: need res and length.", c.Name)
+			}
+			if c.Res == 0 {
+				c.Res = spec.res
+			}
+			if c.Length == 0 {
+				c.Length = spec.length
+			}
+		}
+		if c.Res <= 0 || c.Length <= 0 {
+			return fmt.Errorf("Loop config error: %s: res and length must be positive.", c.Name)
+		}
+		if c.Length%c.Res != 0 {
+			return fmt.Errorf("Loop config error: %s: res must divide length.", c.Name)
+		}
+		if len(c.CF) == 0 {
+			c.CF = cfList{"AVERAGE"}
+		}
+		seen := make(map[string]bool)
+		for _, cf := range c.CF {
+			if _, ok := cfSuffixes[cf]; !ok {
+				return fmt.Errorf("Loop config error: %s: invalid cf %s.", c.Name, cf)
+			}
+			if seen[cf] {
+				return fmt.Errorf("Loop config error: %s: duplicate cf %s.", c.Name, cf)
+			}
+			seen[cf] = true
+		}
+		for name, ds := range c.DS {
+			if ds.Format != "" && !validFormat(ds.Format) {
+				return fmt.Errorf("Loop config error: %s: invalid format for %s.", c.Name, name)
+			}
+		}
+		seen = make(map[string]bool)
+		later := make(map[string]bool)
+		for _, s := range c.Series {
+			later[s.Name] = true
+		}
+		for _, s := range c.Series {
+			if !vnameRegexp.MatchString(s.Name) {
+				return fmt.Errorf("Loop config error: %s: invalid series name %q.", c.Name, s.Name)
+			}
+			if seen[s.Name] {
+				return fmt.Errorf("Loop config error: %s: duplicate series %s.", c.Name, s.Name)
+			}
+			if c.reservedName(s.Name) {
+				return fmt.Errorf("Loop config error: %s: series name %s clashes with a data source or column.", c.Name, s.Name)
+			}
+			seen[s.Name] = true
+			delete(later, s.Name)
+			if s.RPN == "" {
+				return fmt.Errorf("Loop config error: %s: series %s has no rpn.", c.Name, s.Name)
+			}
+			for _, token := range strings.Split(s.RPN, ",") {
+				if token == s.Name || later[token] {
+					return fmt.Errorf("Loop config error: %s: series %s refers to %s before it is defined.", c.Name, s.Name, token)
+				}
+			}
+			if s.Format != "" && !validFormat(s.Format) {
+				return fmt.Errorf("Loop config error: %s: invalid format for %s.", c.Name, s.Name)
+			}
+		}
+		if err := c.Gaps.setDefaults(); err != nil {
+			return fmt.Errorf("Loop config error: %s: %v", c.Name, err)
+		}
+		if c.Worksheet == "" {
+			c.Worksheet = preset
+		}
+	case "profile", "mining":
+		if c.Worksheet == "" {
+			c.Worksheet = c.Kind
+		}
+		if c.Kind == "profile" {
+			if err := c.profileOptions().validate(); err != nil {
+				return fmt.Errorf("Loop config error: %s: %v", c.Name, err)
+			}
+		}
+		if c.Kind == "mining" && c.MFRCutoff == 0 {
+			c.MFRCutoff = 0.95
+		}
+	case "scores":
+		if c.Worksheet == "" {
+			c.Worksheet = "predictscores"
+		}
+		if err := c.scoresOptions().validate(); err != nil {
+			return fmt.Errorf("Loop config error: %s: %v", c.Name, err)
+		}
+	default:
+		return fmt.Errorf("Loop config error: %s: invalid kind %s.", c.Name, c.Kind)
+	}
+	return nil
+}
+
+// reservedName reports whether a series name would clash with the vnames
+// or CSV columns of the data sources known at load time, the time and
+// coverage columns, the raw values of scaled data sources, or the columns
+// of other names with CF suffixes.
+func (c *loopConfig) reservedName(name string) bool {
+	if name == "time" || name == "coverage" || strings.HasSuffix(name, "_raw") {
+		return true
+	}
+	if _, ok := c.DS[name]; ok {
+		return true
+	}
+	if _, ok := defaultDSConfig[name]; ok || name == dsMempoolSize {
+		return true
+	}
+	if len(c.CF) > 1 {
+		for _, suffix := range cfSuffixes {
+			if strings.HasSuffix(name, "_"+suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *loopConfig) profileOptions() profileOptions {
+	return profileOptions{
+		TxRatePoints:  c.TxRatePoints,
+		CapRatePoints: c.CapRatePoints,
+		MempoolPoints: c.MempoolPoints,
+		RateUnit:      c.RateUnit,
+		MaxConf:       c.MaxConf,
+	}
+}
+
+func (c *loopConfig) scoresOptions() scoresOptions {
+	return scoresOptions{Undefined: c.Undefined, CI: c.CI}
+}
+
+func (c *loopConfig) mainSpec() mainSpec {
+	return mainSpec{res: c.Res, length: c.Length, cfs: c.CF, ds: c.DS, series: c.Series, gaps: c.Gaps}
+}
+
+// vnameRegexp matches valid rrdtool variable names.
+var vnameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,255}$`)
+
+// cfList is a list of consolidation functions, which can be written in YAML
+// as a single name or a sequence of names.
+type cfList []string
+
+func (l *cfList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var cf string
+	if err := unmarshal(&cf); err == nil {
+		*l = cfList{cf}
+		return nil
+	}
+	var cfs []string
+	if err := unmarshal(&cfs); err != nil {
+		return err
+	}
+	*l = cfs
+	return nil
+}
+
+// jobEnv holds the loop command options that jobs are built from.
+type jobEnv struct {
+	rrdfile    string
+	host, port string
+	imgdir     string
+	imgformat  string
+	imglog     bool
+
+	sinkspec string
+	sinkcfg  sinkConfig
+
+	mu    sync.Mutex
+	sinks map[string]Sink // by spec, from newBaseSink
+}
+
+// sink returns the Sink for spec, or for the default spec if it is empty,
+// retrying with the given policy merged onto the global one. Jobs with the
+// same spec share the underlying sink.
+func (e *jobEnv) sink(spec string, retry retryPolicy) (Sink, error) {
+	if spec == "" {
+		spec = e.sinkspec
+	}
+	s, err := e.baseSink(spec)
+	if err != nil {
+		return nil, err
+	}
+	return uploadSink(spec, s, e.sinkcfg, retry.merge(e.sinkcfg.retry))
+}
+
+func (e *jobEnv) baseSink(spec string) (Sink, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s, ok := e.sinks[spec]; ok {
+		return s, nil
+	}
+	s, err := newBaseSink(spec, e.sinkcfg)
+	if err != nil {
+		return nil, err
+	}
+	e.sinks[spec] = s
+	return s, nil
+}
+
+// replaySink returns the Sink used to replay spooled worksheets to spec.
+// It tries each worksheet once, as the spool is drained again later.
+func (e *jobEnv) replaySink(spec string) (Sink, error) {
+	s, err := e.baseSink(spec)
+	if err != nil {
+		return nil, err
+	}
+	policy := e.sinkcfg.retry
+	policy.Attempts = 1
+	return &meteredSink{&retrySink{s, policy}}, nil
+}
+
+// newJob returns the plotting function for a job config, which must have
+// had its defaults set.
+func (e *jobEnv) newJob(c loopConfig) (func(context.Context) error, error) {
+	if c.Kind == "render" {
+		if e.imgdir == "" {
+			return nil, errors.New("Need to specify image directory with -o for render jobs.")
+		}
+		render := newRenderer(e.rrdfile, e.imgdir, e.imgformat, e.imglog)
+		return func(ctx context.Context) error { return render(ctx, c.mainSpec(), c.Worksheet) }, nil
+	}
+
+	s, err := e.sink(c.Sink, c.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Loop config error: %s: %v", c.Name, err)
+	}
+	switch c.Kind {
+	case "main":
+		plotMain := newMainPlotter(e.rrdfile, s)
+		return func(ctx context.Context) error { return plotMain(ctx, c.mainSpec(), c.Worksheet) }, nil
+	case "profile":
+		return newProfilePlotter(newFeesimClient(e.host, e.port), c.profileOptions(), s, c.Worksheet), nil
+	case "mining":
+		return newMiningPlotter(c.MFRCutoff, newFeesimClient(e.host, e.port), s, c.Worksheet), nil
+	case "scores":
+		return newScoresPlotter(newFeesimClient(e.host, e.port), c.scoresOptions(), s, c.Worksheet), nil
+	default:
+		panic("Error should have been returned by setDefaults.")
+	}
+}
+
+// readLoopConfig reads the loop config file and sets the job defaults.
+func readLoopConfig(configfile string) ([]loopConfig, error) {
+	var cfg []loopConfig
+	if c, err := ioutil.ReadFile(configfile); err != nil {
+		return nil, err
+	} else if err := yaml.Unmarshal(c, &cfg); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range cfg {
+		if err := cfg[i].setDefaults(); err != nil {
+			return nil, err
+		}
+		if names[cfg[i].Name] {
+			return nil, fmt.Errorf("Loop config error: duplicate job name %s.", cfg[i].Name)
+		}
+		names[cfg[i].Name] = true
+	}
+	return cfg, nil
+}
+
+// scheduler runs the loop jobs, and can replace them with the jobs from a
+// new config.
+type scheduler struct {
+	ctx     context.Context
+	env     *jobEnv
+	tracker *jobTracker
+	logger  *Logger
+	wg      sync.WaitGroup
+	running map[string]*runningJob
+}
+
+type runningJob struct {
+	cfg    loopConfig
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the loop has returned
+}
+
+func newScheduler(ctx context.Context, env *jobEnv, tracker *jobTracker, logger *Logger) *scheduler {
+	return &scheduler{
+		ctx:     ctx,
+		env:     env,
+		tracker: tracker,
+		logger:  logger,
+		running: make(map[string]*runningJob),
+	}
+}
+
+// apply stops the running jobs which are not in cfg, starts the jobs in cfg
+// which are not running, and restarts the jobs whose config has changed.
+// Unchanged jobs are left running. If any new job can't be built, nothing
+// is changed.
+func (s *scheduler) apply(cfg []loopConfig) error {
+	var added, removed, changed []string
+	jobs := make(map[string]func(context.Context) error)
+	keep := make(map[string]bool)
+	for _, c := range cfg {
+		keep[c.Name] = true
+		if r, ok := s.running[c.Name]; ok && reflect.DeepEqual(r.cfg, c) {
+			continue
+		} else if ok {
+			changed = append(changed, c.Name)
+		} else {
+			added = append(added, c.Name)
+		}
+		job, err := s.env.newJob(c)
+		if err != nil {
+			return err
+		}
+		jobs[c.Name] = job
+	}
+	for name := range s.running {
+		if !keep[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+
+	for _, name := range removed {
+		s.stop(name)
+		s.tracker.remove(name)
+	}
+	for _, c := range cfg {
+		if job, ok := jobs[c.Name]; ok {
+			s.start(job, c, s.stop(c.Name))
+		}
+	}
+	s.logger.Printf("Loop jobs: added %v, removed %v, changed %v, unchanged %d",
+		added, removed, changed, len(cfg)-len(added)-len(changed))
+	return nil
+}
+
+// start starts the loop of a job once prev, if non-nil, is closed, so that
+// a restarted job's runs don't overlap with those of its old loop.
+func (s *scheduler) start(job func(context.Context) error, c loopConfig, prev <-chan struct{}) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+	s.running[c.Name] = &runningJob{cfg: c, cancel: cancel, done: done}
+	s.tracker.start(c)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		if ctx.Err() == nil {
+			loop(ctx, job, c, s.tracker, s.logger)
+		}
+	}()
+}
+
+// stop cancels the named job, including any run in progress, and returns a
+// channel which is closed when its loop has returned, or nil if it isn't
+// running.
+func (s *scheduler) stop(name string) <-chan struct{} {
+	r, ok := s.running[name]
+	if !ok {
+		return nil
+	}
+	r.cancel()
+	delete(s.running, name)
+	return r.done
+}
+
+// stopAll stops all jobs and waits up to grace for them to return,
+// reporting whether they did.
+func (s *scheduler) stopAll(grace time.Duration) bool {
+	for name := range s.running {
+		s.stop(name)
+	}
+	waitc := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(waitc)
+	}()
+	select {
+	case <-waitc:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// recovered logs the stack of the recovered panic r, and returns it as an
+// error.
+func recovered(ctx context.Context, r interface{}) error {
+	err := fmt.Errorf("Panic: %v", r)
+	loggerFrom(ctx).With(logFields{"error": err}).Printf("[ERROR] %v\n%s", err, debug.Stack())
+	return err
+}
+
+type runResult struct {
+	attempt  time.Time
+	duration time.Duration
+	err      error
+}
+
+// runJob runs f, cancelling it after deadline if deadline is non-zero. A
+// panic in f is returned as an error, so that one bad plot doesn't take
+// down the other jobs.
+func runJob(ctx context.Context, f func(context.Context) error, deadline time.Duration) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(ctx, r)
+		}
+	}()
+	if deadline == 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	err = f(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Deadline of %v exceeded: %v", deadline, err)
+	}
+	return err
+}
+
+// loop runs f at unix times which are multiples of the period plus the
+// offset. Runs are started in their own goroutines, so a slow run doesn't
+// shift the schedule; cfg.Overlap decides what happens to runs that are due
+// while earlier ones are in progress.
+//
+// Once ctx is done, runs in progress are cancelled and loop returns when they
+// have, without recording their results.
+func loop(ctx context.Context, f func(context.Context) error, cfg loopConfig, tracker *jobTracker, logger *Logger) {
+	period := time.Duration(cfg.Period) * time.Second
+	deadline := time.Duration(cfg.Deadline) * time.Second
+
+	// Wait until unix time (s) is a multiple of loop period,
+	// then wait further for offset seconds.
+	t := time.Now().Unix()
+	wait := cfg.Period - (t % cfg.Period) + cfg.Offset
+	next := time.Unix(t+wait, 0)
+	logger = logger.With(logFields{"job": cfg.Name, "kind": cfg.Kind, "worksheet": cfg.Worksheet})
+	ctx = withLogger(ctx, logger)
+	logger.Printf("Starting loop %s, waiting for %ds", cfg.Name, wait)
+
+	var (
+		running int
+		pending bool
+		results = make(chan runResult)
+	)
+	run := func() {
+		running++
+		jobRuns.Inc(cfg.Name)
+		go func() {
+			attempt := time.Now()
+			err := runJob(ctx, f, deadline)
+			results <- runResult{attempt, time.Since(attempt), err}
+		}()
+	}
+	// drain waits for the cancelled runs in progress to return.
+	drain := func() {
+		for ; running > 0; running-- {
+			<-results
+		}
+	}
+	skip := func(reason string) {
+		jobSkipped.Inc(cfg.Name)
+		logger.Printf("Skipped run of %s: %s", cfg.Name, reason)
+	}
+
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			switch {
+			case running < cfg.MaxConcurrent:
+				run()
+			case cfg.Overlap == "catchup" && !pending:
+				pending = true
+				logger.Printf("Run of %s still in progress, will catch up when done", cfg.Name)
+			default:
+				skip(fmt.Sprintf("%d run(s) still in progress", running))
+			}
+			// Keep to the schedule, skipping any runs that were missed
+			// entirely, e.g. because the system was suspended.
+			next = next.Add(period)
+			for now := time.Now(); !next.After(now); next = next.Add(period) {
+				skip("missed schedule")
+			}
+			timer.Reset(time.Until(next))
+		case r := <-results:
+			running--
+			if ctx.Err() != nil {
+				// The job was stopped, so the run was cancelled.
+				drain()
+				return
+			}
+			tracker.record(cfg.Name, r.attempt, r.err)
+			rl := logger.With(logFields{"duration": r.duration, "error": r.err})
+			if r.err != nil {
+				jobFailures.Inc(cfg.Name)
+				rl.Printf("[ERROR] Plotting %s: %v", cfg.Name, r.err)
+			} else {
+				jobLastSuccess.Set(cfg.Name, float64(time.Now().Unix()))
+				rl.Printf("Plotted %s", cfg.Name)
+			}
+			if pending {
+				pending = false
+				run()
+			}
+		case <-ctx.Done():
+			drain()
+			return
+		}
+	}
+}
+
+func doLoop(args []string, sinkspec string, sinkcfg sinkConfig, logger *Logger) error {
+	var (
+		rrdfile    string
+		configfile string
+		host, port string
+		imgdir     string
+		imgformat  string
+		imglog     bool
+		metrics    string
+		health     string
+		readyMax   int64
+		grace      time.Duration
+		drainEvery time.Duration
+	)
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.StringVar(&rrdfile, "f", "./rrd.db", "Path to RRD file.")
+	f.StringVar(&configfile, "c", "./plotcfg.yml", "Path to loop config file.")
+	f.StringVar(&host, "host", "localhost", "api host")
+	f.StringVar(&port, "port", "8350", "api port")
+	f.StringVar(&imgdir, "o", "", "Output directory for render jobs.")
+	f.StringVar(&imgformat, "t", "png", "Image format for render jobs, png or svg.")
+	f.BoolVar(&imglog, "log", false, "Use a logarithmic y-axis for render jobs.")
+	f.StringVar(&metrics, "metrics", "", "Listen address for Prometheus metrics; disabled if empty.")
+	f.StringVar(&health, "health", "", "Listen address for /healthz and /readyz; disabled if empty.")
+	f.Int64Var(&readyMax, "readyperiods", 3, "Periods without success before a job fails readiness.")
+	f.DurationVar(&grace, "grace", 30*time.Second, "Time to wait for cancelled jobs on shutdown.")
+	f.DurationVar(&drainEvery, "spoolinterval", time.Minute, "Interval between attempts to replay spooled worksheets.")
+	if err := f.Parse(args[1:]); err != nil {
+		return err
+	}
+	if rrdfile == "" {
+		return errors.New("Need to specify RRD file with -f.")
+	}
+
+	cfg, err := readLoopConfig(configfile)
+	if err != nil {
+		return err
+	}
+
+	env := &jobEnv{
+		rrdfile:   rrdfile,
+		host:      host,
+		port:      port,
+		imgdir:    imgdir,
+		imgformat: imgformat,
+		imglog:    imglog,
+		sinkspec:  sinkspec,
+		sinkcfg:   sinkcfg,
+		sinks:     make(map[string]Sink),
+	}
+
+	// The metrics and health endpoints share a listener if given the same
+	// address.
+	tracker := newJobTracker()
+	muxes := make(map[string]*http.ServeMux)
+	handle := func(addr, pattern string, h http.HandlerFunc) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].HandleFunc(pattern, h)
+	}
+	if metrics != "" {
+		handle(metrics, "/metrics", metricsHandler)
+	}
+	if health != "" {
+		handle(health, "/healthz", tracker.healthHandler(readyMax))
+		handle(health, "/readyz", tracker.healthHandler(readyMax))
+	}
+	for addr, mux := range muxes {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		go func(ln net.Listener, mux *http.ServeMux) { logger.Println(http.Serve(ln, mux)) }(ln, mux)
+		logger.Printf("Serving status endpoints on %s", addr)
+	}
+
+	sched := newScheduler(context.Background(), env, tracker, logger)
+	if err := sched.apply(cfg); err != nil {
+		return err
+	}
+	logger.Println("Plot loops started.")
+
+	drainCtx, stopDrain := context.WithCancel(context.Background())
+	defer stopDrain()
+	if sinkcfg.spool != "" {
+		go drainSpools(drainCtx, sinkcfg.spool, drainEvery, env.replaySink, logger)
+	}
+
+	sigc := make(chan os.Signal, 3)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigc {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		logger.Printf("Received SIGHUP, reloading %s", configfile)
+		if cfg, err := readLoopConfig(configfile); err != nil {
+			logger.Printf("[ERROR] Reloading loop config: %v", err)
+		} else if err := sched.apply(cfg); err != nil {
+			logger.Printf("[ERROR] Reloading loop config: %v", err)
+		}
+	}
+	logger.Println("Received signal, waiting on goroutines..")
+	stopDrain()
+	if !sched.stopAll(grace) {
+		logger.Printf("[ERROR] Jobs still running after %v, exiting anyway", grace)
+		killPutsheets()
+		return nil
+	}
+	logger.Println("Shutdown OK")
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunJobRecovers(t *testing.T) {
+	logger, _ := newLogger(ioutil.Discard, "text")
+	ctx := withLogger(context.Background(), logger)
+	err := runJob(ctx, func(context.Context) error {
+		var m map[string]interface{}
+		_ = m["x"].([]interface{})
+		return nil
+	}, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "Panic: ") {
+		t.Fatalf("Got error %v, want panic error.", err)
+	}
+
+	// The API client runs calls in their own goroutines.
+	c := &feesimClient{}
+	err = c.call(ctx, func() error { panic("bad response") })
+	if err == nil || err.Error() != "Panic: bad response" {
+		t.Fatalf("Got error %v, want panic error.", err)
+	}
+}
+
+func TestRunJobDeadline(t *testing.T) {
+	err := runJob(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, 10*time.Millisecond)
+	if err == nil || !strings.HasPrefix(err.Error(), "Deadline of 10ms exceeded") {
+		t.Fatalf("Got error %v, want deadline error.", err)
+	}
+	if err := runJob(context.Background(), func(context.Context) error { return nil }, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeriesNames(t *testing.T) {
+	for _, tc := range []struct {
+		cfs    cfList
+		series []seriesConfig
+		ok     bool
+	}{
+		{nil, []seriesConfig{{Name: "total", RPN: "txbyterate,capbyterate,+"}, {Name: "half", RPN: "total,2,/"}}, true},
+		{nil, []seriesConfig{{Name: "txbyterate", RPN: "capbyterate"}}, false},
+		{nil, []seriesConfig{{Name: "mempoolsize_raw", RPN: "mempoolsize"}}, false},
+		{nil, []seriesConfig{{Name: "time", RPN: "mempoolsize"}}, false},
+		{nil, []seriesConfig{{Name: "coverage", RPN: "mempoolsize"}}, false},
+		{nil, []seriesConfig{{Name: "total_max", RPN: "mempoolsize"}}, true},
+		{cfList{"AVERAGE", "MAX"}, []seriesConfig{{Name: "total_max", RPN: "mempoolsize"}}, false},
+		{nil, []seriesConfig{{Name: "half", RPN: "total,2,/"}, {Name: "total", RPN: "mempoolsize"}}, false},
+		{nil, []seriesConfig{{Name: "loop", RPN: "loop,1,+"}}, false},
+	} {
+		c := loopConfig{Name: "1m", Period: 60, CF: tc.cfs, Series: tc.series}
+		if err := c.setDefaults(); (err == nil) != tc.ok {
+			t.Errorf("%+v: got error %v, want ok %v.", tc.series, err, tc.ok)
+		}
+	}
+}
+
+func newTestScheduler(t *testing.T) *scheduler {
+	logger, _ := newLogger(ioutil.Discard, "text")
+	env := &jobEnv{
+		sinkspec: "dir:" + t.TempDir(),
+		sinkcfg:  sinkConfig{retry: defaultRetryPolicy},
+		sinks:    make(map[string]Sink),
+	}
+	s := newScheduler(context.Background(), env, newJobTracker(), logger)
+	t.Cleanup(func() { s.stopAll(time.Second) })
+	return s
+}
+
+func TestSchedulerApply(t *testing.T) {
+	s := newTestScheduler(t)
+	job := func(name string, period int64) loopConfig {
+		c := loopConfig{Name: name, Period: period}
+		if err := c.setDefaults(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if err := s.apply([]loopConfig{job("profile", 3600), job("mining", 3600), job("scores", 3600)}); err != nil {
+		t.Fatal(err)
+	}
+	profile, mining := s.running["profile"], s.running["mining"]
+
+	// Profile unchanged, mining changed, scores removed and 1m added.
+	if err := s.apply([]loopConfig{job("profile", 3600), job("mining", 7200), job("1m", 3600)}); err != nil {
+		t.Fatal(err)
+	}
+	if s.running["profile"] != profile {
+		t.Error("Unchanged job restarted.")
+	}
+	if r := s.running["mining"]; r == mining || r.cfg.Period != 7200 {
+		t.Error("Changed job not restarted.")
+	}
+	if _, ok := s.running["scores"]; ok {
+		t.Error("Removed job still running.")
+	}
+	if _, ok := s.running["1m"]; !ok {
+		t.Error("Added job not running.")
+	}
+	statuses, _ := s.tracker.status(time.Now(), 3)
+	var names []string
+	for _, st := range statuses {
+		names = append(names, st.Name)
+	}
+	if strings.Join(names, ",") != "1m,mining,profile" {
+		t.Errorf("Tracked jobs %v, want [1m mining profile].", names)
+	}
+
+	// A job that can't be built leaves the running jobs alone.
+	if err := s.apply([]loopConfig{job("render_1m", 3600)}); err == nil {
+		t.Fatal("No error for a render job without an image directory.")
+	}
+	if len(s.running) != 3 {
+		t.Errorf("%d jobs running after a failed apply, want 3.", len(s.running))
+	}
+}
+
+// TestSchedulerRestart checks that a restarted job's loop waits for the old
+// one, whose cancelled run isn't recorded.
+func TestSchedulerRestart(t *testing.T) {
+	s := newTestScheduler(t)
+	c := loopConfig{Name: "job", Kind: "profile", Period: 1}
+	if err := c.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.start(func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		<-release // e.g. an rrd call that can't be interrupted
+		return ctx.Err()
+	}, c, nil)
+	<-started
+
+	// The restarted job sends the error recorded before its first run.
+	restarted := make(chan string, 10)
+	s.start(func(ctx context.Context) error {
+		statuses, _ := s.tracker.status(time.Now(), 3)
+		restarted <- statuses[0].LastError
+		return nil
+	}, c, s.stop("job"))
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case <-restarted:
+		t.Fatal("Restarted job ran while the old run was in progress.")
+	default:
+	}
+	close(release)
+	select {
+	case lastError := <-restarted:
+		if lastError != "" {
+			t.Errorf("Cancelled run recorded error %q.", lastError)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Restarted job didn't run.")
+	}
+}
+
+func TestMainWindow(t *testing.T) {
+	for _, tc := range []struct {
+		c           loopConfig
+		res, length int64
+	}{
+		{loopConfig{Name: "1m"}, 60, 10800},
+		{loopConfig{Name: "1m", Res: 120}, 120, 10800},
+		{loopConfig{Name: "render_3h", Length: 21600}, 10800, 21600},
+		{loopConfig{Name: "hourly", Kind: "main", Res: 3600}, 0, 0},
+		{loopConfig{Name: "1m", Res: 7}, 0, 0},
+		{loopConfig{Name: "1m", Length: -60}, 0, 0},
+	} {
+		c := tc.c
+		c.Period = 60
+		err := c.setDefaults()
+		if tc.res == 0 {
+			if err == nil {
+				t.Errorf("%+v: no error, got res %d and length %d.", tc.c, c.Res, c.Length)
+			}
+		} else if err != nil || c.Res != tc.res || c.Length != tc.length {
+			t.Errorf("%+v: got res %d, length %d, error %v, want %d and %d.", tc.c, c.Res, c.Length, err, tc.res, tc.length)
+		}
+	}
+}
+
+func counterValue(c *counterVec, label string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[label]
+}
+
+// eventually reports whether cond becomes true within timeout.
+func eventually(cond func() bool, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// startLoop runs the loop of a job with a period of 1s, whose runs block
+// until released, and returns the channel each run sends on when it starts.
+func startLoop(t *testing.T, c loopConfig, release <-chan struct{}, logger *Logger) <-chan struct{} {
+	c.Kind, c.Period = "profile", 1
+	if err := c.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if logger == nil {
+		logger, _ = newLogger(ioutil.Discard, "text")
+	}
+	started := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loop(ctx, func(ctx context.Context) error {
+			started <- struct{}{}
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil
+		}, c, newJobTracker(), logger)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return started
+}
+
+func waitStarted(t *testing.T, started <-chan struct{}, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-started:
+	case <-time.After(timeout):
+		t.Fatalf("No run started within %v.", timeout)
+	}
+}
+
+func notStarted(t *testing.T, started <-chan struct{}, d time.Duration) {
+	t.Helper()
+	select {
+	case <-started:
+		t.Fatalf("Run started within %v.", d)
+	case <-time.After(d):
+	}
+}
+
+func TestLoopOverlap(t *testing.T) {
+	t.Run("skip", func(t *testing.T) {
+		t.Parallel()
+		name := "overlap-skip"
+		release := make(chan struct{})
+		started := startLoop(t, loopConfig{Name: name}, release, nil)
+		waitStarted(t, started, 2*time.Second)
+		// The runs due while the first is in progress are skipped.
+		if !eventually(func() bool { return counterValue(jobSkipped, name) == 2 }, 3*time.Second) {
+			t.Fatalf("%v runs skipped, want 2.", counterValue(jobSkipped, name))
+		}
+		close(release)
+		// The next run is on schedule, not straight after the first.
+		notStarted(t, started, 500*time.Millisecond)
+		waitStarted(t, started, time.Second)
+		if runs := counterValue(jobRuns, name); runs != 2 {
+			t.Errorf("%v runs, want 2.", runs)
+		}
+	})
+
+	t.Run("catchup", func(t *testing.T) {
+		t.Parallel()
+		name := "overlap-catchup"
+		release := make(chan struct{})
+		started := startLoop(t, loopConfig{Name: name, Overlap: "catchup"}, release, nil)
+		waitStarted(t, started, 2*time.Second)
+		// The first run due is pending, and only the second is skipped.
+		if !eventually(func() bool { return counterValue(jobSkipped, name) == 1 }, 3*time.Second) {
+			t.Fatalf("%v runs skipped, want 1.", counterValue(jobSkipped, name))
+		}
+		if runs := counterValue(jobRuns, name); runs != 1 {
+			t.Fatalf("%v runs before catching up, want 1.", runs)
+		}
+		close(release)
+		// The pending run starts as soon as the first finishes.
+		waitStarted(t, started, 300*time.Millisecond)
+		if runs := counterValue(jobRuns, name); runs != 2 {
+			t.Errorf("%v runs, want 2.", runs)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+		name := "overlap-concurrent"
+		release := make(chan struct{})
+		started := startLoop(t, loopConfig{Name: name, Overlap: "concurrent", MaxConcurrent: 2}, release, nil)
+		waitStarted(t, started, 2*time.Second)
+		waitStarted(t, started, 1500*time.Millisecond)
+		// A third run would exceed maxconcurrent.
+		if !eventually(func() bool { return counterValue(jobSkipped, name) == 1 }, 1500*time.Millisecond) {
+			t.Fatalf("%v runs skipped, want 1.", counterValue(jobSkipped, name))
+		}
+		if runs := counterValue(jobRuns, name); runs != 2 {
+			t.Errorf("%v runs, want 2.", runs)
+		}
+	})
+
+	t.Run("missed", func(t *testing.T) {
+		t.Parallel()
+		name := "overlap-missed"
+		release := make(chan struct{})
+		close(release)
+		// Stall the loop after the first run for 2.5 periods, as if the
+		// system had been suspended.
+		w := &stallingWriter{match: "Plotted", d: 2500 * time.Millisecond}
+		logger, _ := newLogger(w, "text")
+		started := startLoop(t, loopConfig{Name: name}, release, logger)
+		waitStarted(t, started, 2*time.Second)
+		// The run due during the stall is run late, and the one after
+		// it, which was missed entirely, is skipped.
+		waitStarted(t, started, 3*time.Second)
+		if skipped := counterValue(jobSkipped, name); skipped != 1 {
+			t.Errorf("%v runs skipped, want 1.", skipped)
+		}
+	})
+}
+
+// stallingWriter blocks for d the first time it is written a line
+// containing match.
+type stallingWriter struct {
+	match   string
+	d       time.Duration
+	stalled bool
+}
+
+func (w *stallingWriter) Write(b []byte) (int, error) {
+	if !w.stalled && strings.Contains(string(b), w.match) {
+		w.stalled = true
+		time.Sleep(w.d)
+	}
+	return len(b), nil
+}
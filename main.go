@@ -1,18 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
-	"time"
-
-	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -27,37 +22,49 @@ const (
 	version = "0.1.2"
 )
 
-type mainPlotter func(resnum int) error
+type mainPlotter func(ctx context.Context, spec mainSpec, worksheet string) error
 
 const usage = `
 feesim-plot [global options] COMMAND [args...]
 
 Commands:
-	loop -f RRDFILE [-host HOST] [-port PORT]
-	main -f RRDFILE -n RESNUMBER
-	profile [-host HOST] [-port PORT]
-	mining [-host HOST] [-port PORT]
-	predictscores [-host HOST] [-port PORT]
+	loop -f RRDFILE [-host HOST] [-port PORT] [-o IMGDIR] [-metrics ADDR] [-health ADDR]
+	main -f RRDFILE -n RESNUMBER [-gaps blank|drop|ffill|interpolate] [-maxgap SECONDS] [-coverage]
+	render -f RRDFILE -o DIR [-n RESNUMBER] [-t png|svg] [-log]
+	export -f RRDFILE -o DIR [-t csv|jsonl] [-start TIME] [-end TIME]
+	profile [-host HOST] [-port PORT] [-replay FILE] [-txratepoints N] [-capratepoints N] [-mempoolpoints N]
+		[-rateunit s|min|10min|block] [-maxconf N]
+	mining [-host HOST] [-port PORT] [-replay FILE]
+	predictscores [-host HOST] [-port PORT] [-replay FILE] [-undefined STR] [-ci LEVEL]
+	snapshot [-host HOST] [-port PORT] [-o DIR] [-txratepoints N] [-capratepoints N] [-mempoolpoints N]
+	serve -f RRDFILE [-host HOST] [-port PORT] [-listen ADDR]
+	spool list|flush [-w WORKSHEET]
 
 `
 
-type loopConfig struct {
-	Name   string `yaml:"name"`
-	Period int64  `yaml:"period"`
-	Offset int64  `yaml:"offset"`
-}
-
 func main() {
 	var (
-		bin         string
-		spreadsheet string
-		auth        string
-		logfile     string
+		sinkcfg   sinkConfig
+		logfile   string
+		logformat string
+		sinkspec  string
 	)
-	flag.StringVar(&bin, "b", "", "path to putsheet binary")
-	flag.StringVar(&spreadsheet, "s", "", "spreadsheet name")
-	flag.StringVar(&auth, "a", "", "path to gspread json auth token")
+	flag.StringVar(&sinkcfg.bin, "b", "", "path to putsheet binary")
+	flag.StringVar(&sinkcfg.spreadsheet, "s", "", "spreadsheet name (spreadsheet ID for the sheets sink)")
+	flag.StringVar(&sinkcfg.auth, "a", "", "path to gspread json auth token")
+	flag.StringVar(&sinkcfg.tokenURL, "tokenurl", "", "OAuth2 token endpoint for the sheets sink")
+	flag.StringVar(&sinkcfg.sheetsURL, "sheetsurl", defaultSheetsURL, "Sheets API base URL for the sheets sink")
 	flag.StringVar(&logfile, "l", "", "path to logfile")
+	flag.StringVar(&logformat, "logformat", "text", "log format: text or json")
+	flag.StringVar(&sinkspec, "sink", "putsheet", "output sink: putsheet, sheets or dir:DIRECTORY")
+	flag.StringVar(&sinkcfg.spool, "spool", "", "directory to spool failed uploads to for later replay")
+	flag.StringVar(&sinkcfg.dedup, "dedup", "", "file to keep upload hashes in, to skip uploads of unchanged worksheets")
+	flag.IntVar(&sinkcfg.retry.Attempts, "attempts", defaultRetryPolicy.Attempts, "upload tries, including the first")
+	flag.DurationVar(&sinkcfg.retry.Backoff, "backoff", defaultRetryPolicy.Backoff, "delay before the first upload retry, doubled after each")
+	flag.DurationVar(&sinkcfg.retry.MaxBackoff, "maxbackoff", defaultRetryPolicy.MaxBackoff, "limit on the delay between upload retries")
+	flag.Float64Var(&sinkcfg.retry.Jitter, "jitter", defaultRetryPolicy.Jitter, "fraction by which upload retry delays are randomly varied")
+	flag.DurationVar(&sinkcfg.retry.Timeout, "attempttimeout", defaultRetryPolicy.Timeout, "limit on each upload try; none if 0")
+	flag.DurationVar(&sinkcfg.retry.KillGrace, "killgrace", defaultRetryPolicy.KillGrace, "time given to putsheet to exit after a try times out")
 	flag.Parse()
 
 	if flag.Arg(0) == "version" {
@@ -65,204 +72,228 @@ func main() {
 		os.Exit(0)
 	}
 
-	if bin == "" || spreadsheet == "" || auth == "" {
-		fmt.Fprintf(os.Stderr, usage)
-		flag.CommandLine.PrintDefaults()
-		log.Fatal("Insufficient arguments.")
+	var logw io.Writer = os.Stderr
+	if logfile != "" {
+		logFileMode := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		f, err := os.OpenFile(logfile, logFileMode, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logw = f
+	}
+	logger, err := newLogger(logw, logformat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sinkcfg.retry.validate(); err != nil {
+		logger.Fatal(err)
 	}
+	// One-shot commands log upload attempts through ctx.
+	ctx := withLogger(context.Background(), logger)
 
-	var logger *log.Logger
-	if logfile == "" {
-		logger = log.New(os.Stderr, "", log.LstdFlags)
-	} else {
-		logFileMode := os.O_WRONLY | os.O_CREATE | os.O_APPEND
-		if f, err := os.OpenFile(logfile, logFileMode, 0666); err != nil {
+	// Only the commands that publish plots need a sink.
+	sink := func() Sink {
+		s, err := newSink(sinkspec, sinkcfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, usage)
+			flag.CommandLine.PrintDefaults()
 			log.Fatal(err)
-		} else {
-			logger = log.New(f, "", log.LstdFlags)
 		}
+		return s
 	}
 
 	switch flag.Arg(0) {
 	case "loop":
-		if err := doLoop(flag.Args(), bin, spreadsheet, auth, logger); err != nil {
+		if err := doLoop(flag.Args(), sinkspec, sinkcfg, logger); err != nil {
 			logger.Fatal(err)
 		}
 	case "main":
-		if err := doMain(flag.Args(), bin, spreadsheet, auth); err != nil {
+		if err := doMain(ctx, flag.Args(), sink()); err != nil {
+			logger.Fatal(err)
+		}
+	case "render":
+		if err := doRender(ctx, flag.Args()); err != nil {
+			logger.Fatal(err)
+		}
+	case "export":
+		if err := doExport(flag.Args()); err != nil {
 			logger.Fatal(err)
 		}
 	case "profile":
-		if err := doProfile(flag.Args(), bin, spreadsheet, auth); err != nil {
+		if err := doProfile(ctx, flag.Args(), sink()); err != nil {
 			logger.Fatal(err)
 		}
 	case "mining":
-		if err := doMining(flag.Args(), bin, spreadsheet, auth); err != nil {
+		if err := doMining(ctx, flag.Args(), sink()); err != nil {
 			logger.Fatal(err)
 		}
 	case "predictscores":
-		if err := doScores(flag.Args(), bin, spreadsheet, auth); err != nil {
+		if err := doScores(ctx, flag.Args(), sink()); err != nil {
 			logger.Fatal(err)
 		}
-	default:
-		logger.Fatal("Invalid command.")
-	}
-}
-
-func loop(f func() error, cfg loopConfig, logger *log.Logger, wg *sync.WaitGroup, done <-chan struct{}) {
-	defer wg.Done()
-
-	// Wait until unix time (s) is a multiple of loop period,
-	// then wait further for offset seconds.
-	t := time.Now().Unix()
-	wait := cfg.Period - (t % cfg.Period) + cfg.Offset
-	waitc := time.After(time.Duration(wait) * time.Second)
-	logger.Printf("Starting loop %s, waiting for %ds", cfg.Name, wait)
-	select {
-	case <-waitc:
-	case <-done:
-		return
-	}
-	logger.Printf("Loop %s, wait done, starting main loop", cfg.Name)
-
-	// Loop starts
-	ticker := time.NewTicker(time.Duration(cfg.Period) * time.Second)
-	defer ticker.Stop()
-	for {
-		if err := f(); err != nil {
-			logger.Printf("[ERROR] Plotting %s: %v", cfg.Name, err)
-		} else {
-			logger.Printf("Plotted %s", cfg.Name)
+	case "snapshot":
+		if err := doSnapshot(ctx, flag.Args()); err != nil {
+			logger.Fatal(err)
+		}
+	case "spool":
+		if err := doSpool(ctx, flag.Args(), sinkcfg.spool, sinkcfg); err != nil {
+			logger.Fatal(err)
 		}
-		select {
-		case <-ticker.C:
-		case <-done:
-			return
+	case "serve":
+		if err := doServe(flag.Args(), logger); err != nil {
+			logger.Fatal(err)
 		}
+	default:
+		logger.Fatal("Invalid command.")
 	}
 }
 
-func doLoop(args []string, bin, spreadsheet, auth string, logger *log.Logger) error {
+func doMain(ctx context.Context, args []string, sink Sink) error {
 	var (
-		rrdfile    string
-		configfile string
-		host, port string
+		rrdfile   string
+		resnumber int
+		gaps      gapPolicy
 	)
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
 	f.StringVar(&rrdfile, "f", "./rrd.db", "Path to RRD file.")
-	f.StringVar(&configfile, "c", "./plotcfg.yml", "Path to loop config file.")
-	f.StringVar(&host, "host", "localhost", "api host")
-	f.StringVar(&port, "port", "8350", "api port")
+	f.IntVar(&resnumber, "n", -1, "Res number, 0-3")
+	f.StringVar(&gaps.Fill, "gaps", "blank", "Unknown values: blank, drop, ffill or interpolate.")
+	f.Int64Var(&gaps.MaxGap, "maxgap", 0, "Longest gap in seconds to ffill or interpolate; no limit if 0.")
+	f.BoolVar(&gaps.Coverage, "coverage", false, "Add a column with the fraction of each row known.")
 	if err := f.Parse(args[1:]); err != nil {
 		return err
 	}
-	if rrdfile == "" {
-		return errors.New("Need to specify RRD file with -f.")
+	if rrdfile == "" || resnumber == -1 {
+		return errors.New("Insufficient args.")
 	}
-
-	var cfg []loopConfig
-	if c, err := ioutil.ReadFile(configfile); err != nil {
-		return err
-	} else if err := yaml.Unmarshal(c, &cfg); err != nil {
+	if err := gaps.setDefaults(); err != nil {
 		return err
 	}
-
-	wg := new(sync.WaitGroup)
-	done := make(chan struct{})
-	plotMain := gspreadMainPlotter(rrdfile, bin, spreadsheet, auth)
-	for _, c := range cfg {
-		var f func() error
-		switch c.Name {
-		case "1m":
-			f = func() error { return plotMain(res1) }
-		case "30m":
-			f = func() error { return plotMain(res30) }
-		case "3h":
-			f = func() error { return plotMain(res180) }
-		case "1d":
-			f = func() error { return plotMain(res1440) }
-		case "profile":
-			f = gspreadProfilePlotter(host, port, bin, spreadsheet, auth)
-		case "mining":
-			f = gspreadMiningPlotter(0.95, host, port, bin, spreadsheet, auth)
-		case "scores":
-			f = gspreadScoresPlotter(host, port, bin, spreadsheet, auth)
-		default:
-			return fmt.Errorf("Loop config error: invalid plot name %s.", c.Name)
-		}
-		wg.Add(1)
-		go loop(f, c, logger, wg, done)
+	spec, err := resSpec(resnumber)
+	if err != nil {
+		return err
 	}
-	logger.Println("Plot loops started.")
-
-	sigc := make(chan os.Signal, 3)
-	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	<-sigc
-	close(done)
-	logger.Println("Received signal, waiting on goroutines..")
-	wg.Wait()
-	logger.Println("Shutdown OK")
-	return nil
+	spec.gaps = gaps
+	plotMain := newMainPlotter(rrdfile, sink)
+	return plotMain(ctx, spec, resNames[resnumber])
 }
 
-func doMain(args []string, bin, spreadsheet, auth string) error {
+func doRender(ctx context.Context, args []string) error {
 	var (
-		rrdfile   string
-		resnumber int
+		rrdfile     string
+		dir         string
+		format      string
+		resnumber   int
+		logarithmic bool
 	)
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
 	f.StringVar(&rrdfile, "f", "./rrd.db", "Path to RRD file.")
-	f.IntVar(&resnumber, "n", -1, "Res number, 0-3")
+	f.StringVar(&dir, "o", "", "Output directory.")
+	f.StringVar(&format, "t", "png", "Image format, png or svg.")
+	f.IntVar(&resnumber, "n", -1, "Res number, 0-3; all if unset")
+	f.BoolVar(&logarithmic, "log", false, "Use a logarithmic y-axis.")
 	if err := f.Parse(args[1:]); err != nil {
 		return err
 	}
-	if rrdfile == "" || resnumber == -1 {
+	if rrdfile == "" || dir == "" {
 		return errors.New("Insufficient args.")
 	}
-	plotMain := gspreadMainPlotter(rrdfile, bin, spreadsheet, auth)
-	return plotMain(resnumber)
+	render := newRenderer(rrdfile, dir, format, logarithmic)
+	if resnumber != -1 {
+		spec, err := resSpec(resnumber)
+		if err != nil {
+			return err
+		}
+		return render(ctx, spec, resNames[resnumber])
+	}
+	for resnum, name := range resNames {
+		spec, _ := resSpec(resnum)
+		if err := render(ctx, spec, name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func doProfile(args []string, bin, spreadsheet, auth string) error {
+func doProfile(ctx context.Context, args []string, sink Sink) error {
 	var (
 		host, port string
+		replay     string
+		opts       profileOptions
 	)
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
 	f.StringVar(&host, "host", "localhost", "api host")
 	f.StringVar(&port, "port", "8350", "api port")
+	f.StringVar(&replay, "replay", "", "Build the plot from a snapshot file instead of the API.")
+	profilePointFlags(f, &opts)
+	f.StringVar(&opts.RateUnit, "rateunit", "10min", "Rate unit: s, min, 10min or block.")
+	f.IntVar(&opts.MaxConf, "maxconf", 0, "Largest conf target in the conf curve; no limit if 0.")
 	if err := f.Parse(args[1:]); err != nil {
 		return err
 	}
-	plotProfile := gspreadProfilePlotter(host, port, bin, spreadsheet, auth)
-	return plotProfile()
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	c, err := apiSource(host, port, replay)
+	if err != nil {
+		return err
+	}
+	plotProfile := newProfilePlotter(c, opts, sink, "profile")
+	return plotProfile(ctx)
 }
 
-func doMining(args []string, bin, spreadsheet, auth string) error {
+// profilePointFlags adds the flags for the numbers of profile points, which
+// a snapshot must share with the profile plots replayed from it.
+func profilePointFlags(f *flag.FlagSet, opts *profileOptions) {
+	f.IntVar(&opts.TxRatePoints, "txratepoints", profileTxRatePoints, "Number of tx rate points.")
+	f.IntVar(&opts.CapRatePoints, "capratepoints", profileCapRatePoints, "Number of capacity rate points.")
+	f.IntVar(&opts.MempoolPoints, "mempoolpoints", profileMempoolPoints, "Number of mempool size points.")
+}
+
+func doMining(ctx context.Context, args []string, sink Sink) error {
 	var (
 		host, port    string
+		replay        string
 		mfrCutoffProb float64
 	)
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
 	f.StringVar(&host, "host", "localhost", "api host")
 	f.StringVar(&port, "port", "8350", "api port")
+	f.StringVar(&replay, "replay", "", "Build the plot from a snapshot file instead of the API.")
 	f.Float64Var(&mfrCutoffProb, "c", 0.95, "MFR cutoff prob")
 	if err := f.Parse(args[1:]); err != nil {
 		return err
 	}
-	plotMining := gspreadMiningPlotter(mfrCutoffProb, host, port, bin, spreadsheet, auth)
-	return plotMining()
+	c, err := apiSource(host, port, replay)
+	if err != nil {
+		return err
+	}
+	plotMining := newMiningPlotter(mfrCutoffProb, c, sink, "mining")
+	return plotMining(ctx)
 }
 
-func doScores(args []string, bin, spreadsheet, auth string) error {
+func doScores(ctx context.Context, args []string, sink Sink) error {
 	var (
 		host, port string
+		replay     string
+		opts       scoresOptions
 	)
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
 	f.StringVar(&host, "host", "localhost", "api host")
 	f.StringVar(&port, "port", "8350", "api port")
+	f.StringVar(&replay, "replay", "", "Build the plot from a snapshot file instead of the API.")
+	f.StringVar(&opts.Undefined, "undefined", "", "Written for the scores of conf times without txs.")
+	f.Float64Var(&opts.CI, "ci", 0, "Confidence level of Wilson score interval columns; none if 0.")
 	if err := f.Parse(args[1:]); err != nil {
 		return err
 	}
-	plotScores := gspreadScoresPlotter(host, port, bin, spreadsheet, auth)
-	return plotScores()
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	c, err := apiSource(host, port, replay)
+	if err != nil {
+		return err
+	}
+	plotScores := newScoresPlotter(c, opts, sink, "predictscores")
+	return plotScores(ctx)
 }
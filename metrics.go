@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics are exported in the Prometheus text format by the loop command's
+// metrics listener.
+var (
+	jobRuns = newCounterVec("feesimplot_job_runs_total",
+		"Number of job runs.", "job")
+	jobFailures = newCounterVec("feesimplot_job_failures_total",
+		"Number of failed job runs.", "job")
+	jobSkipped = newCounterVec("feesimplot_job_skipped_total",
+		"Number of job runs skipped due to overlap.", "job")
+	jobLastSuccess = newGaugeVec("feesimplot_job_last_success_timestamp_seconds",
+		"Unix time of the last successful job run.", "job")
+	uploadRetries = newCounterVec("feesimplot_upload_retries_total",
+		"Number of upload retries.", "worksheet")
+	uploadsSkipped = newCounterVec("feesimplot_uploads_skipped_total",
+		"Number of uploads skipped because the worksheet was unchanged.", "worksheet")
+	spooledUploads = newCounterVec("feesimplot_spooled_uploads_total",
+		"Number of failed uploads spooled for replay.", "worksheet")
+	spoolReplayed = newCounterVec("feesimplot_spool_replayed_total",
+		"Number of spooled uploads replayed.", "worksheet")
+	fetchDuration = newHistogramVec("feesimplot_fetch_duration_seconds",
+		"Time taken to fetch plot data.", "plot", latencyBuckets)
+	uploadDuration = newHistogramVec("feesimplot_upload_duration_seconds",
+		"Time taken to upload a worksheet, including retries.", "worksheet", latencyBuckets)
+	mempoolSize = newGaugeVec("feesimplot_mempool_size_bytes",
+		"Latest known mempool size in the main plot.", "plot")
+	mfrCutoff = newGaugeVec("feesimplot_mfr_cutoff",
+		"Min fee rate at the MFR cutoff prob in the mining plot.", "plot")
+	predictScore = newGaugeVec("feesimplot_predictscore",
+		"Overall prediction score, over all conf times.", "plot")
+	unknownRatio = newGaugeVec("feesimplot_main_unknown_ratio",
+		"Fraction of the values in the main plot window which are unknown.", "plot")
+
+	allMetrics = []metric{
+		jobRuns, jobFailures, jobSkipped, jobLastSuccess, uploadRetries,
+		uploadsSkipped, spooledUploads, spoolReplayed,
+		fetchDuration, uploadDuration,
+		mempoolSize, mfrCutoff, predictScore, unknownRatio,
+	}
+)
+
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 180}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// observeSince records the seconds elapsed since start in h.
+func observeSince(h *histogramVec, label string, start time.Time) {
+	h.Observe(label, time.Since(start).Seconds())
+}
+
+type metricVec struct {
+	name, help, typ, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	for _, l := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", m.name, m.label, strconv.Quote(l), formatValue(m.values[l]))
+	}
+}
+
+type counterVec struct {
+	metricVec
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{metricVec{name: name, help: help, typ: "counter", label: label, values: make(map[string]float64)}}
+}
+
+func (c *counterVec) Inc(label string) {
+	c.mu.Lock()
+	c.values[label]++
+	c.mu.Unlock()
+}
+
+type gaugeVec struct {
+	metricVec
+}
+
+func newGaugeVec(name, help, label string) *gaugeVec {
+	return &gaugeVec{metricVec{name: name, help: help, typ: "gauge", label: label, values: make(map[string]float64)}}
+}
+
+func (g *gaugeVec) Set(label string, v float64) {
+	g.mu.Lock()
+	g.values[label] = v
+	g.mu.Unlock()
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu    sync.Mutex
+	hists map[string]*histogram
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, hists: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.hists[label]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.hists[label] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := make([]string, 0, len(h.hists))
+	for l := range h.hists {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		hist, ql := h.hists[l], strconv.Quote(l)
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"%s\"} %d\n", h.name, h.label, ql, formatValue(le), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"+Inf\"} %d\n", h.name, h.label, ql, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s=%s} %s\n", h.name, h.label, ql, formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count{%s=%s} %d\n", h.name, h.label, ql, hist.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
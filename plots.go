@@ -2,54 +2,138 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/bitcoinfees/feesim/api"
 	"github.com/ziutek/rrd"
 )
 
+// scoresOptions are the options of the scores plot.
+type scoresOptions struct {
+	// Undefined is written for the scores of conf times without any txs.
+	Undefined string
+	// CI is the confidence level of the Wilson score interval columns; the
+	// columns are left out if it is zero.
+	CI float64
+}
+
+func (o scoresOptions) validate() error {
+	if strings.ContainsAny(o.Undefined, ",\n") {
+		return errors.New("Undefined score sentinel can't contain commas or newlines.")
+	}
+	if o.CI < 0 || o.CI >= 1 {
+		return errors.New("Score confidence level must be in [0, 1).")
+	}
+	return nil
+}
+
 type scoresPlot struct {
-	scores  []float64
-	txTotal []float64
+	opts     scoresOptions
+	attained []float64
+	txTotal  []float64
 }
 
-func (p *scoresPlot) Fetch(c *api.Client) error {
-	s, err := c.Scores()
+func (p *scoresPlot) Fetch(ctx context.Context, c feesimAPI) error {
+	s, err := c.Scores(ctx)
+	if err != nil {
+		return err
+	}
+
+	series, err := decodeSeries("predictscores", s, "attained", "exceeded")
 	if err != nil {
 		return err
 	}
+	attained, exceeded := series[0], series[1]
 
-	scores := make([]float64, len(s["attained"]))
-	txTotal := make([]float64, len(s["attained"]))
-	for i := range scores {
-		txTotal[i] = s["attained"][i] + s["exceeded"][i]
-		scores[i] = s["attained"][i] / txTotal[i]
+	txTotal := make([]float64, len(attained))
+	for i := range txTotal {
+		if attained[i] < 0 || exceeded[i] < 0 {
+			return fmt.Errorf("Bad feesim API response: predictscores: negative tx count for conf %d.", i+1)
+		}
+		txTotal[i] = attained[i] + exceeded[i]
 	}
 
-	p.scores = scores
+	p.attained = attained
 	p.txTotal = txTotal
 	return nil
 }
 
+// score returns the score of the conf time with index i, and whether it is
+// defined, which it isn't if there were no txs.
+func (p *scoresPlot) score(i int) (float64, bool) {
+	if p.txTotal[i] == 0 {
+		return 0, false
+	}
+	return p.attained[i] / p.txTotal[i], true
+}
+
 func (p *scoresPlot) CSV() ([]byte, error) {
-	if p.scores == nil || p.txTotal == nil {
+	if p.attained == nil || p.txTotal == nil {
 		return nil, errors.New("Data not yet fetched.")
 	}
 	buf := new(bytes.Buffer)
-	fmt.Fprintln(buf, "conf,scores,txtotal")
-	for i, score := range p.scores {
-		fmt.Fprintf(buf, "%d,%f,%.0f\n", i+1, score, p.txTotal[i])
+	if p.opts.CI != 0 {
+		fmt.Fprintln(buf, "conf,scores,txtotal,lower,upper")
+	} else {
+		fmt.Fprintln(buf, "conf,scores,txtotal")
+	}
+	for i := range p.attained {
+		score, ok := p.score(i)
+		fmt.Fprintf(buf, "%d,%s,%.0f", i+1, p.formatScore(score, ok), p.txTotal[i])
+		if p.opts.CI != 0 {
+			lower, upper, ok := wilsonInterval(p.attained[i], p.txTotal[i], p.opts.CI)
+			fmt.Fprintf(buf, ",%s,%s", p.formatScore(lower, ok), p.formatScore(upper, ok))
+		}
+		fmt.Fprintln(buf)
 	}
 	return buf.Bytes(), nil
 }
 
-func newScoresPlot(c *api.Client) (*scoresPlot, error) {
-	p := new(scoresPlot)
-	if err := p.Fetch(c); err != nil {
+func (p *scoresPlot) formatScore(score float64, defined bool) string {
+	if !defined {
+		return p.opts.Undefined
+	}
+	return fmt.Sprintf("%f", score)
+}
+
+// overall returns the prediction score over all conf times, and whether it
+// is defined.
+func (p *scoresPlot) overall() (float64, bool) {
+	var attained, total float64
+	for i := range p.attained {
+		attained += p.attained[i]
+		total += p.txTotal[i]
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return attained / total, true
+}
+
+// wilsonInterval returns the Wilson score interval, at the given confidence
+// level, of the proportion of successes in n trials. It is undefined if n
+// is zero.
+func wilsonInterval(successes, n, level float64) (lower, upper float64, ok bool) {
+	if n == 0 {
+		return 0, 0, false
+	}
+	z := math.Sqrt2 * math.Erfinv(level)
+	phat := successes / n
+	denom := 1 + z*z/n
+	center := (phat + z*z/(2*n)) / denom
+	half := z * math.Sqrt(phat*(1-phat)/n+z*z/(4*n*n)) / denom
+	return math.Max(0, center-half), math.Min(1, center+half), true
+}
+
+func newScoresPlot(ctx context.Context, c feesimAPI, opts scoresOptions) (*scoresPlot, error) {
+	p := &scoresPlot{opts: opts}
+	if err := p.Fetch(ctx, c); err != nil {
 		return nil, err
 	}
 	return p, nil
@@ -63,17 +147,20 @@ type miningPlot struct {
 	mbs_y []float64
 }
 
-func (p *miningPlot) Fetch(c *api.Client, mfrCutoffProb float64) error {
-	blksrc, err := c.BlockSource()
+func (p *miningPlot) Fetch(ctx context.Context, c feesimAPI, mfrCutoffProb float64) error {
+	r, err := c.BlockSource(ctx)
+	if err != nil {
+		return err
+	}
+	blksrc, err := decodeBlockSource(r)
 	if err != nil {
 		return err
 	}
 
-	mfr := blksrc["minfeerates"].([]interface{})
+	mfr := blksrc.minFeeRates
 	mfrLen := len(mfr)
 	var mfr_x []float64
-	for _, feerate := range mfr {
-		f := feerate.(float64)
+	for _, f := range mfr {
 		if f >= 0 {
 			// f == -1 means +Inf MFR
 			mfr_x = append(mfr_x, f)
@@ -88,12 +175,8 @@ func (p *miningPlot) Fetch(c *api.Client, mfrCutoffProb float64) error {
 		mfr_y = mfr_y[:i]
 	}
 
-	mbs := blksrc["maxblocksizes"].([]interface{})
-	mbsLen := len(mbs)
-	mbs_x := make([]float64, len(mbs))
-	for i, size := range mbs {
-		mbs_x[i] = size.(float64)
-	}
+	mbs_x := blksrc.maxBlockSizes
+	mbsLen := len(mbs_x)
 	mbs_y := make([]float64, len(mbs_x))
 	for i := range mbs_y {
 		mbs_y[i] = float64(i) / float64(mbsLen)
@@ -128,15 +211,86 @@ func (p *miningPlot) CSV(subplot string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func newMiningPlot(c *api.Client, mfrCutoffProb float64) (*miningPlot, error) {
+// cutoff returns the highest min fee rate below the MFR cutoff prob.
+func (p *miningPlot) cutoff() (float64, bool) {
+	if len(p.mfr_x) == 0 {
+		return 0, false
+	}
+	return p.mfr_x[len(p.mfr_x)-1], true
+}
+
+func newMiningPlot(ctx context.Context, c feesimAPI, mfrCutoffProb float64) (*miningPlot, error) {
 	p := new(miningPlot)
-	if err := p.Fetch(c, mfrCutoffProb); err != nil {
+	if err := p.Fetch(ctx, c, mfrCutoffProb); err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+// profileOptions are the options of the profile plot. Zero values are
+// replaced by the defaults.
+type profileOptions struct {
+	// Numbers of points requested from the API for the tx rate, capacity
+	// rate and mempool size curves.
+	TxRatePoints  int
+	CapRatePoints int
+	MempoolPoints int
+	// RateUnit is the time unit of the tx and capacity rates: s, min, 10min
+	// or block, the expected block interval of 10 minutes.
+	RateUnit string
+	// MaxConf is the largest conf target in the conf curve; no limit if 0.
+	MaxConf int
+}
+
+// Default numbers of points requested from the API for the profile plot.
+const (
+	profileTxRatePoints  = 20
+	profileCapRatePoints = 50
+	profileMempoolPoints = 30
+)
+
+// rateUnits are the lengths in seconds of the profile rate units.
+var rateUnits = map[string]float64{
+	"s":     1,
+	"min":   60,
+	"10min": 600,
+	"block": 600,
+}
+
+func (o profileOptions) validate() error {
+	if o.TxRatePoints < 0 || o.CapRatePoints < 0 || o.MempoolPoints < 0 {
+		return errors.New("Number of profile points must not be negative.")
+	}
+	if _, ok := rateUnits[o.RateUnit]; !ok && o.RateUnit != "" {
+		return fmt.Errorf("Invalid rate unit %s.", o.RateUnit)
+	}
+	if o.MaxConf < 0 {
+		return errors.New("Max conf target must not be negative.")
+	}
+	return nil
+}
+
+// withDefaults returns the options with the zero values replaced by the
+// defaults.
+func (o profileOptions) withDefaults() profileOptions {
+	if o.TxRatePoints == 0 {
+		o.TxRatePoints = profileTxRatePoints
+	}
+	if o.CapRatePoints == 0 {
+		o.CapRatePoints = profileCapRatePoints
+	}
+	if o.MempoolPoints == 0 {
+		o.MempoolPoints = profileMempoolPoints
+	}
+	if o.RateUnit == "" {
+		o.RateUnit = "10min"
+	}
+	return o
+}
+
 type profilePlot struct {
+	opts profileOptions
+
 	txrate_x []float64
 	txrate_y []float64
 
@@ -150,45 +304,60 @@ type profilePlot struct {
 	conf_y []int
 }
 
-func (p *profilePlot) Fetch(c *api.Client) error {
-	txrate, err := c.TxRate(20)
+func (p *profilePlot) Fetch(ctx context.Context, c feesimAPI) error {
+	opts := p.opts.withDefaults()
+	unit := rateUnits[opts.RateUnit]
+	txrate, err := c.TxRate(ctx, opts.TxRatePoints)
 	if err != nil {
 		return err
 	}
-	// Convert to bytes/decaminute
-	for i := range txrate["y"] {
-		txrate["y"][i] *= 600
+	txrate_x, txrate_y, err := decodeXY("txrate", txrate)
+	if err != nil {
+		return err
 	}
-	p.txrate_x = txrate["x"]
-	p.txrate_y = txrate["y"]
+	// Convert to bytes per rate unit
+	for i := range txrate_y {
+		txrate_y[i] *= unit
+	}
+	p.txrate_x = txrate_x
+	p.txrate_y = txrate_y
 
-	caprate, err := c.CapRate(50)
+	caprate, err := c.CapRate(ctx, opts.CapRatePoints)
 	if err != nil {
 		return err
 	}
-	// Convert to bytes/decaminute
-	for i := range caprate["y"] {
-		caprate["y"][i] *= 600
+	caprate_x, caprate_y, err := decodeXY("caprate", caprate)
+	if err != nil {
+		return err
 	}
-	p.caprate_x = caprate["x"]
-	p.caprate_y = caprate["y"]
+	// Convert to bytes per rate unit
+	for i := range caprate_y {
+		caprate_y[i] *= unit
+	}
+	p.caprate_x = caprate_x
+	p.caprate_y = caprate_y
 
-	mempool, err := c.MempoolSize(30)
+	mempool, err := c.MempoolSize(ctx, opts.MempoolPoints)
 	if err != nil {
 		return err
 	}
-	p.mempool_x = mempool["x"]
-	p.mempool_y = mempool["y"]
+	if p.mempool_x, p.mempool_y, err = decodeXY("mempoolsize", mempool); err != nil {
+		return err
+	}
 
-	var result []float64
-	if r, err := c.EstimateFee(0); err != nil {
+	r, err := c.EstimateFee(ctx, 0)
+	if err != nil {
 		return err
-	} else {
-		rslice := r.([]interface{})
-		result = make([]float64, len(rslice))
-		for i, feerate := range rslice {
-			result[i] = feerate.(float64) * coin
-		}
+	}
+	result, err := decodeEstimateFee(r)
+	if err != nil {
+		return err
+	}
+	if opts.MaxConf > 0 && len(result) > opts.MaxConf {
+		result = result[:opts.MaxConf]
+	}
+	for i := range result {
+		result[i] *= coin
 	}
 	// De-duplicate result feerates
 	conftimes := make(map[int]int)
@@ -245,104 +414,443 @@ func (p *profilePlot) CSV(subplot string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func newProfilePlot(c *api.Client) (*profilePlot, error) {
-	p := new(profilePlot)
-	if err := p.Fetch(c); err != nil {
+func newProfilePlot(ctx context.Context, c feesimAPI, opts profileOptions) (*profilePlot, error) {
+	p := &profilePlot{opts: opts}
+	if err := p.Fetch(ctx, c); err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+// RRD data sources with non-default conversion or formatting.
+const (
+	dsMempoolSize = "mempoolsize"
+	dsTxByteRate  = "txbyterate"
+	dsCapByteRate = "capbyterate"
+)
+
+// dsConfig sets how the values of a data source are converted and formatted
+// in the main plot.
+type dsConfig struct {
+	Scale  float64 `yaml:"scale"`  // multiplier; 0 means the data source's default, 1 for most
+	Format string  `yaml:"format"` // fmt verb; defaults to %.0f
+}
+
+// defaultDSConfig converts txbyterate and capbyterate to bytes/decaminute.
+var defaultDSConfig = map[string]dsConfig{
+	dsTxByteRate:  {Scale: 600, Format: "%f"},
+	dsCapByteRate: {Scale: 600, Format: "%f"},
+}
+
+// dsConf returns the config for the named data source, with the fields not
+// set in ds taken from defaultDSConfig.
+func dsConf(ds map[string]dsConfig, name string) dsConfig {
+	c, d := ds[name], defaultDSConfig[name]
+	if c.Scale == 0 {
+		c.Scale = d.Scale
+	}
+	if c.Scale == 0 {
+		c.Scale = 1
+	}
+	if c.Format == "" {
+		c.Format = d.Format
+	}
+	if c.Format == "" {
+		c.Format = "%.0f"
+	}
+	return c
+}
+
+// validFormat reports whether format formats a single float64 as one CSV
+// cell, without commas or line breaks.
+func validFormat(format string) bool {
+	s := fmt.Sprintf(format, 1.0)
+	return !strings.Contains(s, "%!") && !strings.ContainsAny(s, ",\r\n")
+}
+
+// rrdDsNames returns the names of the data sources in rrdfile, in the order
+// they are stored.
+func rrdDsNames(rrdfile string) ([]string, error) {
+	inf, err := rrd.Info(rrdfile)
+	if err != nil {
+		return nil, err
+	}
+	index, ok := inf["ds.index"].(map[string]interface{})
+	if !ok || len(index) == 0 {
+		return nil, errors.New("No data sources in RRD info.")
+	}
+	names := make([]string, len(index))
+	for name, v := range index {
+		i, ok := v.(uint)
+		if !ok || int(i) >= len(names) || names[i] != "" {
+			return nil, fmt.Errorf("Invalid index for data source %s.", name)
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+
+// cfSuffixes are the column name suffixes used when a main plot has more
+// than one consolidation function.
+var cfSuffixes = map[string]string{
+	"AVERAGE": "avg",
+	"MIN":     "min",
+	"MAX":     "max",
+	"LAST":    "last",
+}
+
+// seriesConfig declares a derived main plot series, computed by rrdtool
+// from an RPN expression. Data source and earlier series names in the
+// expression refer to their converted values.
+type seriesConfig struct {
+	Name   string `yaml:"name"`
+	RPN    string `yaml:"rpn"`
+	Format string `yaml:"format"` // fmt verb; defaults to %.0f
+}
+
 type mainPlot struct {
 	res, length int64 // in seconds
-	rrdfile, cf string
+	rrdfile     string
+	cfs         []string
+	ds          map[string]dsConfig
+	series      []seriesConfig
+	gaps        gapPolicy
+
+	data    [][]float64
+	names   []string
+	formats []string
+}
 
-	data  [][]float64
-	names []string
+// vname returns the name of the variable, and CSV column, holding the values
+// of a data source or series for the given CF. With more than one CF, the CF
+// is appended to the name, e.g. mempoolsize_max.
+func (p *mainPlot) vname(name, cf string) string {
+	if len(p.cfs) > 1 {
+		return name + "_" + cfSuffixes[cf]
+	}
+	return name
 }
 
-func (p *mainPlot) Fetch(t int64) error {
-	if p.length%p.res != 0 {
-		return errors.New("res must divide length.")
+// Fetch fetches the window ending at t. The rrd calls can't be interrupted,
+// so ctx is only checked between them.
+func (p *mainPlot) Fetch(ctx context.Context, t int64) error {
+	if p.res <= 0 || p.length <= 0 || p.length%p.res != 0 {
+		return errors.New("res must be positive and divide length.")
+	}
+	if len(p.cfs) == 0 {
+		return errors.New("No consolidation function.")
+	}
+
+	dsNames, err := rrdDsNames(p.rrdfile)
+	if err != nil {
+		return err
 	}
 
 	end := time.Unix(t-(t%p.res), 0)
 	length := time.Duration(p.length) * time.Second
 	start := end.Add(-length)
 	res := time.Duration(p.res) * time.Second
+	n := p.length / p.res
 
-	f, err := rrd.Fetch(p.rrdfile, p.cf, start, end, res)
+	// Names usable in series RPN expressions
+	vars := make(map[string]bool)
+	for _, name := range dsNames {
+		vars[name] = true
+	}
+	for _, s := range p.series {
+		if vars[s.Name] {
+			return fmt.Errorf("Series %s clashes with a data source.", s.Name)
+		}
+		vars[s.Name] = true
+	}
+
+	e := rrd.NewExporter()
+	e.SetMaxRows(uint(n))
+	step := "step=" + strconv.FormatInt(p.res, 10)
+	for _, cf := range p.cfs {
+		for _, name := range dsNames {
+			v := p.vname(name, cf)
+			if scale := dsConf(p.ds, name).Scale; scale != 1 {
+				e.Def(v+"_raw", p.rrdfile, name, cf, step)
+				e.CDef(v, v+"_raw,"+strconv.FormatFloat(scale, 'g', -1, 64)+",*")
+			} else {
+				e.Def(v, p.rrdfile, name, cf, step)
+			}
+		}
+		for _, s := range p.series {
+			tokens := strings.Split(s.RPN, ",")
+			for i, token := range tokens {
+				if vars[token] {
+					tokens[i] = p.vname(token, cf)
+				}
+			}
+			e.CDef(p.vname(s.Name, cf), strings.Join(tokens, ","))
+		}
+	}
+
+	p.names = []string{"time"}
+	p.formats = []string{"%.0f"}
+	for _, name := range dsNames {
+		for _, cf := range p.cfs {
+			v := p.vname(name, cf)
+			e.XportDef(v, v)
+			p.names = append(p.names, v)
+			p.formats = append(p.formats, dsConf(p.ds, name).Format)
+		}
+	}
+	for _, s := range p.series {
+		format := s.Format
+		if format == "" {
+			format = "%.0f"
+		}
+		for _, cf := range p.cfs {
+			v := p.vname(s.Name, cf)
+			e.XportDef(v, v)
+			p.names = append(p.names, v)
+			p.formats = append(p.formats, format)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	x, err := e.Xport(start, end, res)
 	if err != nil {
 		return err
 	}
-
-	n := p.length / p.res
-	if int(n) != f.RowCnt-2 {
+	defer x.FreeValues()
+	if int(n) != x.RowCnt {
 		return errors.New("Row number mismatch.")
 	}
-	if len(f.DsNames) != 11 {
+	if len(x.Legends) != len(p.names)-1 {
 		return errors.New("Col number mismatch.")
 	}
 
 	p.data = make([][]float64, n)
 	ti := start.Unix() + p.res
 	for i := range p.data {
-		p.data[i] = make([]float64, 12)
-		for j := range p.data[i] {
-			if j == 0 {
-				p.data[i][j] = float64(ti)
-				ti += p.res
-				continue
+		row := make([]float64, len(p.names))
+		row[0] = float64(ti)
+		ti += p.res
+		for j := range x.Legends {
+			row[j+1] = x.ValueAt(j, i)
+		}
+		p.data[i] = row
+	}
+	return nil
+}
+
+// latest returns the last known value of the named data source or series,
+// for the first CF.
+func (p *mainPlot) latest(name string) (float64, bool) {
+	if len(p.cfs) == 0 {
+		return 0, false
+	}
+	v := p.vname(name, p.cfs[0])
+	for j, col := range p.names {
+		if col != v {
+			continue
+		}
+		for i := len(p.data) - 1; i >= 0; i-- {
+			if x := p.data[i][j]; !math.IsNaN(x) {
+				return x, true
 			}
-			p.data[i][j] = f.ValueAt(j-1, i)
 		}
 	}
-	// Convert to bytes/decaminute for txbyterate and capbyterate
-	p.names = append([]string{"time"}, f.DsNames...)
-	for i := range p.data {
-		p.data[i][10] *= 600
-		p.data[i][11] *= 600
+	return 0, false
+}
+
+// unknownRatio returns the fraction of the values in the window which are
+// unknown.
+func (p *mainPlot) unknownRatio() float64 {
+	var unknown, total int
+	for _, row := range p.data {
+		for _, v := range row[1:] {
+			if math.IsNaN(v) {
+				unknown++
+			}
+			total++
+		}
 	}
-	return nil
+	if total == 0 {
+		return 0
+	}
+	return float64(unknown) / float64(total)
 }
 
+// CSV writes the window with its unknown values handled according to the
+// gap policy. Values which are still unknown are left blank.
 func (p *mainPlot) CSV() ([]byte, error) {
 	if p.data == nil {
 		return nil, errors.New("Data not yet fetched.")
 	}
 	buf := new(bytes.Buffer)
-	fmt.Fprintln(buf, strings.Join(p.names, ","))
-	for _, row := range p.data {
-		irow := make([]interface{}, len(row))
-		for i, el := range row {
-			irow[i] = el
+	names := p.names
+	if p.gaps.Coverage {
+		names = append(names[:len(names):len(names)], "coverage")
+	}
+	fmt.Fprintln(buf, strings.Join(names, ","))
+	cells := make([]string, len(names))
+	for i, row := range p.gaps.fill(p.data, p.res) {
+		if row == nil {
+			continue
+		}
+		for j, el := range row {
+			if math.IsNaN(el) {
+				cells[j] = ""
+			} else {
+				cells[j] = fmt.Sprintf(p.formats[j], el)
+			}
+		}
+		if p.gaps.Coverage {
+			cells[len(cells)-1] = fmt.Sprintf("%.3f", rowCoverage(p.data[i]))
 		}
-		fmt.Fprintf(buf, "%.0f,%.0f,%.0f,%.0f,%.0f,%.0f,%.0f,%.0f,%.0f,%.0f,%f,%f\n", irow...)
+		fmt.Fprintln(buf, strings.Join(cells, ","))
 	}
 	return buf.Bytes(), nil
 }
 
-func newMainPlot(t int64, rrdfile string, resnum int) (*mainPlot, error) {
-	plot := new(mainPlot)
-	plot.cf = "AVERAGE"
-	plot.rrdfile = rrdfile
+// rowCoverage returns the fraction of the values in a row, less the time,
+// which are known.
+func rowCoverage(row []float64) float64 {
+	if len(row) < 2 {
+		return 1
+	}
+	var known int
+	for _, v := range row[1:] {
+		if !math.IsNaN(v) {
+			known++
+		}
+	}
+	return float64(known) / float64(len(row)-1)
+}
+
+// gapPolicy is how the unknown values in a main plot, such as those in gaps
+// in the RRD updates, are written.
+type gapPolicy struct {
+	// Fill is blank, which leaves unknown values blank, drop, which drops
+	// the rows with any unknown values, ffill, which repeats the last known
+	// value, or interpolate, which interpolates linearly between the known
+	// values either side of a gap.
+	Fill string `yaml:"fill"`
+	// MaxGap is the length in seconds of the longest gap that ffill or
+	// interpolate fills; longer gaps are left blank. No limit if zero.
+	MaxGap int64 `yaml:"maxgap"`
+	// Coverage adds a column with the fraction of each row's values which
+	// were known.
+	Coverage bool `yaml:"coverage"`
+}
+
+func (g *gapPolicy) setDefaults() error {
+	switch g.Fill {
+	case "":
+		g.Fill = "blank"
+	case "blank", "drop", "ffill", "interpolate":
+	default:
+		return fmt.Errorf("Invalid gap fill %s.", g.Fill)
+	}
+	if g.MaxGap < 0 {
+		return errors.New("Max gap must not be negative.")
+	}
+	return nil
+}
+
+// fill returns a copy of data, with rows res seconds apart, with the
+// unknown values filled in according to the policy. Dropped rows are nil.
+func (g gapPolicy) fill(data [][]float64, res int64) [][]float64 {
+	filled := make([][]float64, len(data))
+	for i, row := range data {
+		filled[i] = append([]float64(nil), row...)
+	}
+	var cols int
+	if len(data) > 0 {
+		cols = len(data[0])
+	}
+	fits := func(gap int) bool {
+		return g.MaxGap == 0 || int64(gap)*res <= g.MaxGap
+	}
+	switch g.Fill {
+	case "drop":
+		for i, row := range filled {
+			if rowCoverage(row) < 1 {
+				filled[i] = nil
+			}
+		}
+	case "ffill":
+		for j := 1; j < cols; j++ {
+			for i := 0; i < len(data); i++ {
+				if !math.IsNaN(data[i][j]) {
+					continue
+				}
+				end := i + 1
+				for end < len(data) && math.IsNaN(data[end][j]) {
+					end++
+				}
+				if i > 0 && fits(end-i) {
+					for k := i; k < end; k++ {
+						filled[k][j] = data[i-1][j]
+					}
+				}
+				i = end
+			}
+		}
+	case "interpolate":
+		for j := 1; j < cols; j++ {
+			last := -1
+			for i := range filled {
+				if math.IsNaN(data[i][j]) {
+					continue
+				}
+				if gap := i - last - 1; last != -1 && gap > 0 && fits(gap) {
+					v0, v1 := data[last][j], data[i][j]
+					for k := last + 1; k < i; k++ {
+						filled[k][j] = v0 + (v1-v0)*float64(k-last)/float64(i-last)
+					}
+				}
+				last = i
+			}
+		}
+	}
+	return filled
+}
+
+// mainSpec describes the window fetched for a main plot.
+type mainSpec struct {
+	res, length int64 // in seconds
+	cfs         []string
+	ds          map[string]dsConfig
+	series      []seriesConfig
+	gaps        gapPolicy
+}
+
+// resSpec returns the spec of the main plot with the given res number.
+func resSpec(resnum int) (mainSpec, error) {
+	spec := mainSpec{cfs: []string{"AVERAGE"}, gaps: gapPolicy{Fill: "blank"}}
 	switch resnum {
 	case res1:
-		plot.res = 60
-		plot.length = 10800
+		spec.res, spec.length = 60, 10800
 	case res30:
-		plot.res = 1800
-		plot.length = 172800
+		spec.res, spec.length = 1800, 172800
 	case res180:
-		plot.res = 10800
-		plot.length = 1209600
+		spec.res, spec.length = 10800, 1209600
 	case res1440:
-		plot.res = 86400
-		plot.length = 15552000
+		spec.res, spec.length = 86400, 15552000
 	default:
-		return nil, errors.New("invalid resnum.")
+		return spec, errors.New("invalid resnum.")
 	}
-	if err := plot.Fetch(t); err != nil {
+	return spec, nil
+}
+
+func newMainPlot(ctx context.Context, t int64, rrdfile string, spec mainSpec) (*mainPlot, error) {
+	plot := new(mainPlot)
+	plot.cfs = spec.cfs
+	plot.rrdfile = rrdfile
+	plot.res = spec.res
+	plot.length = spec.length
+	plot.ds = spec.ds
+	plot.series = spec.series
+	plot.gaps = spec.gaps
+	if err := plot.Fetch(ctx, t); err != nil {
 		return nil, err
 	}
 	return plot, nil
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGapPolicies(t *testing.T) {
+	nan := math.NaN()
+	data := [][]float64{
+		{60, nan, 1},
+		{120, 10, 2},
+		{180, nan, 3},
+		{240, nan, nan},
+		{300, 40, 5},
+		{360, nan, 6},
+	}
+	for _, tc := range []struct {
+		gaps gapPolicy
+		want string
+	}{
+		{
+			gapPolicy{Fill: "blank"},
+			"time,a,b\n60,,1\n120,10,2\n180,,3\n240,,\n300,40,5\n360,,6\n",
+		},
+		{
+			gapPolicy{Fill: "drop"},
+			"time,a,b\n120,10,2\n300,40,5\n",
+		},
+		{
+			gapPolicy{Fill: "ffill"},
+			"time,a,b\n60,,1\n120,10,2\n180,10,3\n240,10,3\n300,40,5\n360,40,6\n",
+		},
+		{
+			gapPolicy{Fill: "ffill", MaxGap: 60},
+			"time,a,b\n60,,1\n120,10,2\n180,,3\n240,,3\n300,40,5\n360,40,6\n",
+		},
+		{
+			gapPolicy{Fill: "interpolate"},
+			"time,a,b\n60,,1\n120,10,2\n180,20,3\n240,30,4\n300,40,5\n360,,6\n",
+		},
+		{
+			gapPolicy{Fill: "interpolate", MaxGap: 60},
+			"time,a,b\n60,,1\n120,10,2\n180,,3\n240,,4\n300,40,5\n360,,6\n",
+		},
+		{
+			gapPolicy{Fill: "blank", Coverage: true},
+			"time,a,b,coverage\n60,,1,0.500\n120,10,2,1.000\n180,,3,0.500\n240,,,0.000\n300,40,5,1.000\n360,,6,0.500\n",
+		},
+	} {
+		p := &mainPlot{
+			res:     60,
+			gaps:    tc.gaps,
+			data:    data,
+			names:   []string{"time", "a", "b"},
+			formats: []string{"%.0f", "%.0f", "%.0f"},
+		}
+		csv, err := p.CSV()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(csv) != tc.want {
+			t.Errorf("%+v: got %q, want %q.", tc.gaps, csv, tc.want)
+		}
+		if !math.IsNaN(data[2][1]) {
+			t.Fatalf("%+v: data modified.", tc.gaps)
+		}
+	}
+
+	p := &mainPlot{data: data}
+	if r := p.unknownRatio(); r != 5.0/12 {
+		t.Errorf("Unknown ratio %f, want %f.", r, 5.0/12)
+	}
+	for _, g := range []gapPolicy{{Fill: "zero"}, {MaxGap: -1}} {
+		if err := g.setDefaults(); err == nil {
+			t.Errorf("No error for %+v.", g)
+		}
+	}
+}
+
+func TestValidFormat(t *testing.T) {
+	for format, want := range map[string]bool{
+		"%.0f":   true,
+		"%f":     true,
+		"%.2e":   true,
+		"%d":     false,
+		"%f %f":  false,
+		"%.0f,":  false,
+		"%f\n":   false,
+		"x=%.1f": true,
+	} {
+		if got := validFormat(format); got != want {
+			t.Errorf("validFormat(%q) = %v, want %v.", format, got, want)
+		}
+	}
+}
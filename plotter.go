@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// timestrSheet returns the worksheet stating the time t of a plot's data.
+func timestrSheet(name string, t time.Time) worksheet {
+	return worksheet{name, []byte(fmt.Sprintf("%s\n%s\n", timestrHeader, t.UTC().Format(time.RFC822)))}
+}
+
+const timestrHeader = "timestr"
+
+// isTimestr reports whether csv is a timestr worksheet, which changes on
+// every run.
+func isTimestr(csv []byte) bool {
+	return bytes.HasPrefix(csv, []byte(timestrHeader+"\n"))
+}
+
+// resNames are the worksheet names of the main plot resolutions.
+var resNames = []string{
+	res1:    "1m",
+	res30:   "30m",
+	res180:  "3h",
+	res1440: "1d",
+}
+
+// resNumber returns the res number with the given name, or -1.
+func resNumber(name string) int {
+	for resnum, resName := range resNames {
+		if name == resName {
+			return resnum
+		}
+	}
+	return -1
+}
+
+func newMainPlotter(rrdfile string, s Sink) mainPlotter {
+	plotMain := func(ctx context.Context, spec mainSpec, worksheet string) error {
+		t := time.Now().Unix()
+		start := time.Now()
+		p, err := newMainPlot(ctx, t, rrdfile, spec)
+		observeSince(fetchDuration, worksheet, start)
+		if err != nil {
+			return err
+		}
+		if v, ok := p.latest(dsMempoolSize); ok {
+			mempoolSize.Set(worksheet, v)
+		}
+		unknownRatio.Set(worksheet, p.unknownRatio())
+		csv, err := p.CSV()
+		if err != nil {
+			return err
+		}
+		return s.Put(ctx, worksheet, csv)
+	}
+	return plotMain
+}
+
+func putProfile(ctx context.Context, p *profilePlot, t time.Time, s Sink, prefix string) error {
+	conf, err := p.CSV("conf")
+	if err != nil {
+		return err
+	}
+	txrate, err := p.CSV("txrate")
+	if err != nil {
+		return err
+	}
+	caprate, err := p.CSV("caprate")
+	if err != nil {
+		return err
+	}
+	mempool, err := p.CSV("mempool")
+	if err != nil {
+		return err
+	}
+
+	return putAll(ctx, s,
+		worksheet{prefix + "_conf", conf},
+		worksheet{prefix + "_txrate", txrate},
+		worksheet{prefix + "_caprate", caprate},
+		worksheet{prefix + "_mempool", mempool},
+		timestrSheet(prefix+"_time", t),
+	)
+}
+
+func newProfilePlotter(c feesimAPI, opts profileOptions, s Sink, prefix string) func(context.Context) error {
+	plotProfile := func(ctx context.Context) error {
+		start := time.Now()
+		t := dataTime(c)
+		p, err := newProfilePlot(ctx, c, opts)
+		observeSince(fetchDuration, prefix, start)
+		if err != nil {
+			return err
+		}
+		return putProfile(ctx, p, t, s, prefix)
+	}
+	return plotProfile
+}
+
+func putMining(ctx context.Context, p *miningPlot, t time.Time, s Sink, prefix string) error {
+	mfr, err := p.CSV("mfr")
+	if err != nil {
+		return err
+	}
+	mbs, err := p.CSV("mbs")
+	if err != nil {
+		return err
+	}
+
+	return putAll(ctx, s,
+		worksheet{prefix + "_mfr", mfr},
+		worksheet{prefix + "_mbs", mbs},
+		timestrSheet(prefix+"_time", t),
+	)
+}
+
+func newMiningPlotter(mfrCutoffProb float64, c feesimAPI, s Sink, prefix string) func(context.Context) error {
+	plotMining := func(ctx context.Context) error {
+		start := time.Now()
+		t := dataTime(c)
+		p, err := newMiningPlot(ctx, c, mfrCutoffProb)
+		observeSince(fetchDuration, prefix, start)
+		if err != nil {
+			return err
+		}
+		if v, ok := p.cutoff(); ok {
+			mfrCutoff.Set(prefix, v)
+		}
+		return putMining(ctx, p, t, s, prefix)
+	}
+	return plotMining
+}
+
+func putScores(ctx context.Context, p *scoresPlot, t time.Time, s Sink, prefix string) error {
+	scores, err := p.CSV()
+	if err != nil {
+		return err
+	}
+
+	return putAll(ctx, s,
+		worksheet{prefix, scores},
+		timestrSheet(prefix+"_time", t),
+	)
+}
+
+func newScoresPlotter(c feesimAPI, opts scoresOptions, s Sink, prefix string) func(context.Context) error {
+	plotScores := func(ctx context.Context) error {
+		start := time.Now()
+		t := dataTime(c)
+		p, err := newScoresPlot(ctx, c, opts)
+		observeSince(fetchDuration, prefix, start)
+		if err != nil {
+			return err
+		}
+		if v, ok := p.overall(); ok {
+			predictScore.Set(prefix, v)
+		}
+		return putScores(ctx, p, t, s, prefix)
+	}
+	return plotScores
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiPlotters are the plotters of the API plots, with the worksheets they
+// put.
+var apiPlotters = []struct {
+	name       string
+	new        func(c feesimAPI, s Sink) func(context.Context) error
+	worksheets []string
+	timestr    string
+}{
+	{
+		"profile",
+		func(c feesimAPI, s Sink) func(context.Context) error {
+			return newProfilePlotter(c, profileOptions{}, s, "profile")
+		},
+		[]string{"profile_conf", "profile_txrate", "profile_caprate", "profile_mempool"},
+		"profile_time",
+	},
+	{
+		"mining",
+		func(c feesimAPI, s Sink) func(context.Context) error { return newMiningPlotter(0.95, c, s, "mining") },
+		[]string{"mining_mfr", "mining_mbs"},
+		"mining_time",
+	},
+	{
+		"scores",
+		func(c feesimAPI, s Sink) func(context.Context) error {
+			return newScoresPlotter(c, scoresOptions{}, s, "predictscores")
+		},
+		[]string{"predictscores"},
+		"predictscores_time",
+	},
+}
+
+func TestAPIPlotters(t *testing.T) {
+	api := newFakeFeesim(t)
+	for _, p := range apiPlotters {
+		t.Run(p.name, func(t *testing.T) {
+			s := newRecordingSink()
+			if err := p.new(api.client(t), s)(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range p.worksheets {
+				csv, ok := s.get(w)
+				if !ok {
+					t.Fatalf("Worksheet %s not put.", w)
+				}
+				checkGolden(t, w+".csv", csv)
+			}
+			timestr, ok := s.get(p.timestr)
+			if !ok {
+				t.Fatal("Timestr worksheet not put.")
+			}
+			lines := strings.Split(strings.TrimSpace(string(timestr)), "\n")
+			if len(lines) != 2 || lines[0] != "timestr" {
+				t.Fatalf("Bad timestr worksheet %q.", timestr)
+			}
+			if _, err := time.Parse(time.RFC822, lines[1]); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestProfileParams(t *testing.T) {
+	api := newFakeFeesim(t)
+	if err := newProfilePlotter(api.client(t), profileOptions{}, newRecordingSink(), "profile")(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]string{
+		"txrate":      "[20]",
+		"caprate":     "[50]",
+		"mempoolsize": "[30]",
+		"estimatefee": "[0]",
+	} {
+		if got := api.params(method); len(got) != 1 || got[0] != want {
+			t.Errorf("%s called with %v, want %s", method, got, want)
+		}
+	}
+}
+
+func TestProfileOptions(t *testing.T) {
+	api := newFakeFeesim(t)
+	s := newRecordingSink()
+	opts := profileOptions{TxRatePoints: 5, CapRatePoints: 7, MempoolPoints: 9, RateUnit: "s", MaxConf: 3}
+	if err := newProfilePlotter(api.client(t), opts, s, "profile")(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]string{
+		"txrate":      "[5]",
+		"caprate":     "[7]",
+		"mempoolsize": "[9]",
+	} {
+		if got := api.params(method); len(got) != 1 || got[0] != want {
+			t.Errorf("%s called with %v, want %s", method, got, want)
+		}
+	}
+	txrate, _ := s.get("profile_txrate")
+	if !strings.HasPrefix(string(txrate), "x,y\n0,1800.500000\n") {
+		t.Errorf("Tx rate not in bytes/s:\n%s", txrate)
+	}
+	conf, _ := s.get("profile_conf")
+	if want := "x,y\n32000,2.000000\n51000,1.000000\n"; string(conf) != want {
+		t.Errorf("Got conf %q, want %q.", conf, want)
+	}
+
+	snap, err := takeSnapshot(context.Background(), api.client(t), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := newRecordingSink()
+	if err := newProfilePlotter(&snapshotAPI{snap}, opts, replayed, "profile")(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := replayed.get("profile_txrate"); string(got) != string(txrate) {
+		t.Errorf("Replayed tx rate %q, want %q.", got, txrate)
+	}
+	if err := newProfilePlotter(&snapshotAPI{snap}, profileOptions{}, replayed, "profile")(context.Background()); err == nil {
+		t.Error("No error replaying a snapshot with different numbers of points.")
+	}
+
+	for _, o := range []profileOptions{{RateUnit: "hour"}, {TxRatePoints: -1}, {MaxConf: -1}} {
+		if err := o.validate(); err == nil {
+			t.Errorf("No error for %+v.", o)
+		}
+	}
+}
+
+func TestAPIPlotterErrors(t *testing.T) {
+	methods := map[string]string{
+		"profile": "caprate",
+		"mining":  "blocksource",
+		"scores":  "predictscores",
+	}
+	for _, p := range apiPlotters {
+		t.Run(p.name+"/api", func(t *testing.T) {
+			api := newFakeFeesim(t)
+			api.setError(methods[p.name], "Not ready.")
+			s := newRecordingSink()
+			if err := p.new(api.client(t), s)(context.Background()); err == nil {
+				t.Fatal("No error when the API call failed.")
+			}
+			if s.puts != 0 {
+				t.Errorf("%d worksheets put after the API call failed.", s.puts)
+			}
+		})
+		t.Run(p.name+"/unreachable", func(t *testing.T) {
+			api := newFakeFeesim(t)
+			c := api.client(t)
+			api.Close()
+			if err := p.new(c, newRecordingSink())(context.Background()); err == nil {
+				t.Fatal("No error when the API was unreachable.")
+			}
+		})
+		t.Run(p.name+"/sink", func(t *testing.T) {
+			api := newFakeFeesim(t)
+			s := newRecordingSink()
+			s.err = errors.New("Sheets down.")
+			if err := p.new(api.client(t), s)(context.Background()); err != s.err {
+				t.Fatalf("Got error %v, want %v.", err, s.err)
+			}
+		})
+		t.Run(p.name+"/cancelled", func(t *testing.T) {
+			api := newFakeFeesim(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := p.new(api.client(t), newRecordingSink())(ctx); err != context.Canceled {
+				t.Fatalf("Got error %v, want %v.", err, context.Canceled)
+			}
+		})
+	}
+}
+
+// TestSnapshotReplay checks that the plots replayed from a snapshot are the
+// same as the live ones.
+func TestSnapshotReplay(t *testing.T) {
+	api := newFakeFeesim(t)
+	snap, err := takeSnapshot(context.Background(), api.client(t), profileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Time = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	replay := &snapshotAPI{snap}
+	for _, p := range apiPlotters {
+		s := newRecordingSink()
+		if err := p.new(replay, s)(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range p.worksheets {
+			csv, _ := s.get(w)
+			checkGolden(t, w+".csv", csv)
+		}
+		// The time of replayed plots is that of the snapshot.
+		if timestr, _ := s.get(p.timestr); string(timestr) != "timestr\n02 Jan 20 03:04 UTC\n" {
+			t.Errorf("Got replayed %s %q, want the snapshot time.", p.timestr, timestr)
+		}
+	}
+
+	if _, err := replay.TxRate(context.Background(), 5); err == nil {
+		t.Error("No error replaying txrate with a different number of points.")
+	}
+	api.setError("blocksource", "Not ready.")
+	snap, err = takeSnapshot(context.Background(), api.client(t), profileOptions{})
+	if err == nil || !strings.Contains(err.Error(), "blocksource") {
+		t.Fatalf("Got error %v, want blocksource error.", err)
+	}
+	if _, err := (&snapshotAPI{snap}).BlockSource(context.Background()); err == nil {
+		t.Error("No error replaying a failed call.")
+	}
+}
+
+func TestScoresUndefinedAndCI(t *testing.T) {
+	api := newFakeFeesim(t)
+	api.setResult("predictscores", `{"attained": [120, 0, 3, 0], "exceeded": [80, 0, 0, 2]}`)
+	s := newRecordingSink()
+	opts := scoresOptions{Undefined: "NA", CI: 0.95}
+	if err := newScoresPlotter(api.client(t), opts, s, "predictscores")(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	csv, _ := s.get("predictscores")
+	checkGolden(t, "predictscores_ci.csv", csv)
+
+	api.setResult("predictscores", `{"attained": [0, 0], "exceeded": [0, 0]}`)
+	p, err := newScoresPlot(context.Background(), api.client(t), scoresOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.overall(); ok {
+		t.Error("Overall score defined without txs.")
+	}
+	csv, _ = p.CSV()
+	if want := "conf,scores,txtotal\n1,,0\n2,,0\n"; string(csv) != want {
+		t.Errorf("Got %q, want %q.", csv, want)
+	}
+}
+
+func TestWilsonInterval(t *testing.T) {
+	// The 0.95 interval for 8 successes in 10 trials.
+	lower, upper, ok := wilsonInterval(8, 10, 0.95)
+	if !ok || math.Abs(lower-0.4902) > 1e-4 || math.Abs(upper-0.9433) > 1e-4 {
+		t.Errorf("Got (%f, %f, %v), want (0.4902, 0.9433, true).", lower, upper, ok)
+	}
+	if _, _, ok := wilsonInterval(0, 0, 0.95); ok {
+		t.Error("Interval defined for no trials.")
+	}
+}
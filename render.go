@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ziutek/rrd"
+)
+
+type chart struct {
+	name string
+	img  []byte
+}
+
+// renderMain draws the mempool size and byterate charts for the main plot
+// window described by spec, in the given image format (png or svg). Only the
+// first of the spec's consolidation functions is drawn.
+func renderMain(ctx context.Context, t int64, rrdfile string, spec mainSpec, title, format string, logarithmic bool) ([]chart, error) {
+	if spec.res <= 0 || spec.length%spec.res != 0 {
+		return nil, errors.New("res must divide length.")
+	}
+	if len(spec.cfs) == 0 {
+		return nil, errors.New("No consolidation function.")
+	}
+	cf := spec.cfs[0]
+	format = strings.ToUpper(format)
+	if format != "PNG" && format != "SVG" {
+		return nil, errors.New("Image format must be png or svg.")
+	}
+
+	end := time.Unix(t-(t%spec.res), 0)
+	start := end.Add(-time.Duration(spec.length) * time.Second)
+	step := "step=" + strconv.FormatInt(spec.res, 10)
+	newGrapher := func(name, vlabel string) *rrd.Grapher {
+		g := rrd.NewGrapher()
+		g.SetTitle(fmt.Sprintf("%s (%s)", name, title))
+		g.SetVLabel(vlabel)
+		g.SetSize(800, 300)
+		g.SetImageFormat(format)
+		if logarithmic {
+			g.SetLogarithmic()
+		}
+		return g
+	}
+
+	mempool := newGrapher("Mempool size", "bytes")
+	mempool.Def("mempool", rrdfile, dsMempoolSize, cf, step)
+	mempool.Area("mempool", "#3366cc", "mempool size")
+
+	// Convert to bytes/decaminute, as in the main plot CSV.
+	rates := newGrapher("Byterates", "bytes/10min")
+	rates.Def("tx", rrdfile, dsTxByteRate, cf, step)
+	rates.Def("cap", rrdfile, dsCapByteRate, cf, step)
+	rates.CDef("txd", "tx,600,*")
+	rates.CDef("capd", "cap,600,*")
+	rates.Line(1.5, "txd", "#dc3912", "tx byterate")
+	rates.Line(1.5, "capd", "#109618", "capacity byterate")
+
+	var charts []chart
+	for _, c := range []struct {
+		name string
+		g    *rrd.Grapher
+	}{{"mempool", mempool}, {"rates", rates}} {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		_, img, err := c.g.Graph(start, end)
+		if err != nil {
+			return nil, fmt.Errorf("Rendering %s: %v", c.name, err)
+		}
+		charts = append(charts, chart{c.name, img})
+	}
+	return charts, nil
+}
+
+// newRenderer returns a function which renders the charts for a main plot
+// spec into dir, as <dir>/<name>_<chart>.<format>.
+func newRenderer(rrdfile, dir, format string, logarithmic bool) mainPlotter {
+	render := func(ctx context.Context, spec mainSpec, name string) error {
+		charts, err := renderMain(ctx, time.Now().Unix(), rrdfile, spec, name, format, logarithmic)
+		if err != nil {
+			return err
+		}
+		for _, c := range charts {
+			name := fmt.Sprintf("%s_%s.%s", name, c.name, strings.ToLower(format))
+			if err := writeFileAtomic(filepath.Join(dir, name), c.img); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return render
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+)
+
+// responseError describes a feesim API response field which doesn't have
+// the expected type.
+func responseError(field, expected string, got interface{}) error {
+	return fmt.Errorf("Bad feesim API response: %s: expected %s, got %s.", field, expected, jsonType(got))
+}
+
+// jsonType returns the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// decodeNumbers decodes the named field as an array of numbers.
+func decodeNumbers(field string, v interface{}) ([]float64, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, responseError(field, "array of numbers", v)
+	}
+	r := make([]float64, len(a))
+	for i, e := range a {
+		f, ok := e.(float64)
+		if !ok {
+			return nil, responseError(fmt.Sprintf("%s[%d]", field, i), "number", e)
+		}
+		r[i] = f
+	}
+	return r, nil
+}
+
+// blockSource is the response to BlockSource.
+type blockSource struct {
+	minFeeRates   []float64 // -1 for an infinite min fee rate
+	maxBlockSizes []float64
+}
+
+func decodeBlockSource(r map[string]interface{}) (*blockSource, error) {
+	if r == nil {
+		return nil, responseError("blocksource", "object", nil)
+	}
+	mfr, err := decodeNumbers("blocksource.minfeerates", r["minfeerates"])
+	if err != nil {
+		return nil, err
+	}
+	mbs, err := decodeNumbers("blocksource.maxblocksizes", r["maxblocksizes"])
+	if err != nil {
+		return nil, err
+	}
+	return &blockSource{minFeeRates: mfr, maxBlockSizes: mbs}, nil
+}
+
+// decodeEstimateFee decodes the response to EstimateFee(0), the fee rates in
+// BTC/kB for each conf time from 1.
+func decodeEstimateFee(r interface{}) ([]float64, error) {
+	return decodeNumbers("estimatefee", r)
+}
+
+// decodeXY returns the x and y series of the named response of TxRate,
+// CapRate or MempoolSize.
+func decodeXY(field string, r map[string][]float64) (x, y []float64, err error) {
+	s, err := decodeSeries(field, r, "x", "y")
+	if err != nil {
+		return nil, nil, err
+	}
+	return s[0], s[1], nil
+}
+
+// decodeSeries returns the named series of a response, which must be present
+// and of the same length.
+func decodeSeries(field string, r map[string][]float64, names ...string) ([][]float64, error) {
+	series := make([][]float64, len(names))
+	for i, name := range names {
+		s, ok := r[name]
+		if !ok {
+			return nil, fmt.Errorf("Bad feesim API response: %s.%s: missing.", field, name)
+		}
+		if i > 0 && len(s) != len(series[0]) {
+			return nil, fmt.Errorf("Bad feesim API response: %s: %s has %d values, %s has %d.",
+				field, names[0], len(series[0]), name, len(s))
+		}
+		series[i] = s
+	}
+	return series, nil
+}
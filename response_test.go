@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMalformedResponses(t *testing.T) {
+	tests := []struct {
+		plotter string
+		method  string
+		result  string
+		want    string
+	}{
+		{"mining", "blocksource", `null`, "blocksource: expected object, got null"},
+		{"mining", "blocksource", `{"maxblocksizes": [1]}`, "blocksource.minfeerates: expected array of numbers, got null"},
+		{"mining", "blocksource", `{"minfeerates": "1000", "maxblocksizes": [1]}`, "blocksource.minfeerates: expected array of numbers, got string"},
+		{"mining", "blocksource", `{"minfeerates": [1000, null], "maxblocksizes": [1]}`, "blocksource.minfeerates[1]: expected number, got null"},
+		{"mining", "blocksource", `{"minfeerates": [1000], "maxblocksizes": {}}`, "blocksource.maxblocksizes: expected array of numbers, got object"},
+		{"profile", "estimatefee", `{"1": 0.0001}`, "estimatefee: expected array of numbers, got object"},
+		{"profile", "estimatefee", `[0.0001, "0.0002"]`, "estimatefee[1]: expected number, got string"},
+		{"profile", "txrate", `{"x": [1, 2]}`, "txrate.y: missing"},
+		{"profile", "caprate", `{"x": [1, 2], "y": [1]}`, "caprate: x has 2 values, y has 1"},
+		{"profile", "mempoolsize", `{}`, "mempoolsize.x: missing"},
+		{"scores", "predictscores", `{"attained": [1, 2], "exceeded": [1]}`, "predictscores: attained has 2 values, exceeded has 1"},
+	}
+	for _, test := range tests {
+		api := newFakeFeesim(t)
+		api.setResult(test.method, test.result)
+		for _, p := range apiPlotters {
+			if p.name != test.plotter {
+				continue
+			}
+			s := newRecordingSink()
+			err := p.new(api.client(t), s)(context.Background())
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("%s %s: got error %v, want %q", test.method, test.result, err, test.want)
+			}
+			if s.puts != 0 {
+				t.Errorf("%s %s: %d worksheets put.", test.method, test.result, s.puts)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy controls how failed uploads are retried. In the loop config,
+// durations are written like "30s", or as a number of seconds, and fields
+// left out default to the global options.
+type retryPolicy struct {
+	Attempts   int           `yaml:"attempts"`   // tries, including the first
+	Backoff    time.Duration `yaml:"backoff"`    // delay before the first retry, doubled after each
+	MaxBackoff time.Duration `yaml:"maxbackoff"` // limit on the delay; none if zero
+	Jitter     float64       `yaml:"jitter"`     // fraction by which delays are randomly varied
+	Timeout    time.Duration `yaml:"timeout"`    // limit on each try; none if zero
+	KillGrace  time.Duration `yaml:"killgrace"`  // putsheet: time to exit after a try times out
+
+	set map[string]bool // fields given in the loop config, by YAML key
+}
+
+func (p *retryPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain retryPolicy
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	p.set = make(map[string]bool, len(fields))
+	for key, v := range fields {
+		p.set[key] = true
+		// yaml.v2 decodes a bare number as nanoseconds.
+		if d, ok := p.durations()[key]; ok {
+			switch v := v.(type) {
+			case int:
+				*d = time.Duration(v) * time.Second
+			case float64:
+				*d = time.Duration(v * float64(time.Second))
+			}
+		}
+	}
+	return nil
+}
+
+// durations returns pointers to the duration fields, by YAML key.
+func (p *retryPolicy) durations() map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"backoff":    &p.Backoff,
+		"maxbackoff": &p.MaxBackoff,
+		"timeout":    &p.Timeout,
+		"killgrace":  &p.KillGrace,
+	}
+}
+
+var defaultRetryPolicy = retryPolicy{
+	Attempts:   3,
+	Backoff:    5 * time.Second,
+	MaxBackoff: time.Minute,
+	Jitter:     0.2,
+	Timeout:    2 * time.Minute,
+	KillGrace:  time.Minute,
+}
+
+func (p retryPolicy) validate() error {
+	switch {
+	case p.Attempts < 0:
+		return errors.New("Retry attempts must not be negative.")
+	case p.Backoff < 0, p.MaxBackoff < 0, p.Timeout < 0, p.KillGrace < 0:
+		return errors.New("Retry durations must not be negative.")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return errors.New("Retry jitter must be between 0 and 1.")
+	}
+	return nil
+}
+
+// merge returns p with its unset fields taken from defaults. A field is set
+// if it was given in the loop config, even as zero, or is non-zero.
+func (p retryPolicy) merge(defaults retryPolicy) retryPolicy {
+	if !p.set["attempts"] && p.Attempts == 0 {
+		p.Attempts = defaults.Attempts
+	}
+	if !p.set["backoff"] && p.Backoff == 0 {
+		p.Backoff = defaults.Backoff
+	}
+	if !p.set["maxbackoff"] && p.MaxBackoff == 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if !p.set["jitter"] && p.Jitter == 0 {
+		p.Jitter = defaults.Jitter
+	}
+	if !p.set["timeout"] && p.Timeout == 0 {
+		p.Timeout = defaults.Timeout
+	}
+	if !p.set["killgrace"] && p.KillGrace == 0 {
+		p.KillGrace = defaults.KillGrace
+	}
+	p.set = nil
+	return p
+}
+
+// backoff returns the delay after the given failed attempt, counting from 1.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff != 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d + time.Duration(p.Jitter*(2*rand.Float64()-1)*float64(d))
+}
+
+// permanentError is an error which retrying won't fix, such as a missing
+// worksheet or a bad auth file.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var perr *permanentError
+	return errors.As(err, &perr)
+}
+
+// retrySink retries failed Puts to the Sink it wraps, giving each try its
+// own timeout.
+type retrySink struct {
+	Sink
+	policy retryPolicy
+}
+
+func (s *retrySink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	logger := loggerFrom(ctx).With(logFields{"worksheet": worksheet})
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := s.try(ctx, worksheet, csv)
+		if err == nil {
+			return nil
+		}
+		fields := logFields{"attempt": attempt, "duration": time.Since(start), "error": err}
+		var perr *putsheetError
+		if errors.As(err, &perr) {
+			fields["stderr"] = perr.stderr
+		}
+		logger.With(fields).Printf("[ERROR] Putting %s, attempt %d: %v", worksheet, attempt, err)
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("%v: %v", ctx.Err(), err)
+		}
+		if isPermanent(err) || attempt >= s.policy.Attempts {
+			return err
+		}
+		uploadRetries.Inc(worksheet)
+		select {
+		case <-time.After(s.policy.backoff(attempt)):
+		case <-ctx.Done():
+			return fmt.Errorf("%v: %v", ctx.Err(), err)
+		}
+	}
+}
+
+func (s *retrySink) try(ctx context.Context, worksheet string, csv []byte) error {
+	if s.policy.Timeout == 0 {
+		return s.Sink.Put(ctx, worksheet, csv)
+	}
+	tctx, cancel := context.WithTimeout(ctx, s.policy.Timeout)
+	defer cancel()
+	err := s.Sink.Put(withKillGrace(tctx, ctx, s.policy.KillGrace), worksheet, csv)
+	if err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timed out after %v: %w", s.policy.Timeout, err)
+	}
+	return err
+}
+
+type killGraceKey struct{}
+
+type killGrace struct {
+	d      time.Duration
+	parent context.Context
+}
+
+// withKillGrace returns a copy of the context of a try, ctx, carrying how
+// long a subprocess is given to exit after being interrupted because the try
+// timed out. If parent, the context of the whole Put, is done, the grace is
+// putsheetKillGrace instead.
+func withKillGrace(ctx, parent context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, killGraceKey{}, killGrace{d, parent})
+}
+
+// killGraceFrom returns the kill grace for a subprocess interrupted because
+// ctx is done, and a channel which is closed if the grace is cut short to
+// putsheetKillGrace by the Put being cancelled.
+func killGraceFrom(ctx context.Context) (time.Duration, <-chan struct{}) {
+	g, ok := ctx.Value(killGraceKey{}).(killGrace)
+	if !ok || g.parent.Err() != nil {
+		return putsheetKillGrace, nil
+	}
+	return g.d, g.parent.Done()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRetryPolicyMerge(t *testing.T) {
+	global := retryPolicy{
+		Attempts:   5,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+		Jitter:     0.5,
+		Timeout:    time.Minute,
+		KillGrace:  10 * time.Second,
+	}
+	for _, tc := range []struct {
+		config string
+		want   retryPolicy
+	}{
+		{"{}", global},
+		{
+			"{attempts: 2, backoff: 2s}",
+			retryPolicy{2, 2 * time.Second, time.Minute, 0.5, time.Minute, 10 * time.Second, nil},
+		},
+		{
+			"{maxbackoff: 0, jitter: 0, timeout: 0s}",
+			retryPolicy{5, time.Second, 0, 0, 0, 10 * time.Second, nil},
+		},
+		{
+			"{backoff: 2, timeout: 120, killgrace: 0.5}",
+			retryPolicy{5, 2 * time.Second, time.Minute, 0.5, 2 * time.Minute, 500 * time.Millisecond, nil},
+		},
+	} {
+		var p retryPolicy
+		if err := yaml.Unmarshal([]byte(tc.config), &p); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.merge(global); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v.", tc.config, got, tc.want)
+		}
+	}
+	if got := (retryPolicy{Attempts: 1}).merge(global); got.Attempts != 1 || got.Backoff != time.Second {
+		t.Errorf("Got %+v, want attempts 1 and the global backoff.", got)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := retryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, want := range []time.Duration{1, 2, 4, 5, 5, 5} {
+		attempt := i + 1
+		if got := p.backoff(attempt); got != want*time.Second {
+			t.Errorf("Attempt %d: got backoff %v, want %v.", attempt, got, want*time.Second)
+		}
+	}
+	p.MaxBackoff = 0
+	if got := p.backoff(8); got != 128*time.Second {
+		t.Errorf("Got unlimited backoff %v, want 2m8s.", got)
+	}
+
+	p = retryPolicy{Backoff: 10 * time.Second, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(1); d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("Backoff %v outside jitter of 10s +/- 20%%.", d)
+		}
+	}
+}
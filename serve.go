@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// plotServer serves the plots over HTTP, fetching them on each request.
+type plotServer struct {
+	rrdfile       string
+	c             feesimAPI
+	mfrCutoffProb float64
+	logger        *Logger
+}
+
+// plotCSV returns the CSV of the plot named by p, which is the request path
+// with the extension removed, e.g. "/main/1m" or "/scores".
+func (s *plotServer) plotCSV(ctx context.Context, p string) ([]byte, error) {
+	dir, name := path.Split(p)
+	switch dir {
+	case "/":
+		if name == "scores" {
+			sp, err := newScoresPlot(ctx, s.c, scoresOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return sp.CSV()
+		}
+	case "/main/":
+		if spec, err := resSpec(resNumber(name)); err == nil {
+			mp, err := newMainPlot(ctx, time.Now().Unix(), s.rrdfile, spec)
+			if err != nil {
+				return nil, err
+			}
+			return mp.CSV()
+		}
+	case "/profile/":
+		switch name {
+		case "conf", "txrate", "caprate", "mempool":
+			pp, err := newProfilePlot(ctx, s.c, profileOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return pp.CSV(name)
+		}
+	case "/mining/":
+		switch name {
+		case "mfr", "mbs":
+			mp, err := newMiningPlot(ctx, s.c, s.mfrCutoffProb)
+			if err != nil {
+				return nil, err
+			}
+			return mp.CSV(name)
+		}
+	}
+	return nil, errNotFound
+}
+
+var errNotFound = errors.New("Not found.")
+
+func (s *plotServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	ext := path.Ext(r.URL.Path)
+	if ext != ".csv" && ext != ".json" {
+		http.NotFound(w, r)
+		return
+	}
+
+	csv, err := s.plotCSV(r.Context(), strings.TrimSuffix(r.URL.Path, ext))
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.logger.Printf("[ERROR] Serving %s: %v", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ext == ".csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Write(csv)
+		return
+	}
+	b, err := csvToJSON(csv)
+	if err != nil {
+		s.logger.Printf("[ERROR] Serving %s: %v", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// csvToJSON converts a plot CSV into {"columns": [...], "rows": [[...], ...]}.
+// Numeric cells are emitted as numbers, empty cells, NaN and Inf as null,
+// and anything else as strings.
+func csvToJSON(csv []byte) ([]byte, error) {
+	table := parseTable(csv)
+	if len(table) == 0 {
+		return nil, errors.New("Empty CSV.")
+	}
+	rows := make([][]interface{}, len(table)-1)
+	for i, line := range table[1:] {
+		row := make([]interface{}, len(line))
+		for j, cell := range line {
+			if cell == "" {
+				row[j] = nil
+			} else if f, err := strconv.ParseFloat(cell, 64); err != nil {
+				row[j] = cell
+			} else if math.IsNaN(f) || math.IsInf(f, 0) {
+				row[j] = nil
+			} else {
+				row[j] = json.Number(cell)
+			}
+		}
+		rows[i] = row
+	}
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(map[string]interface{}{
+		"columns": table[0],
+		"rows":    rows,
+	})
+	return buf.Bytes(), err
+}
+
+func doServe(args []string, logger *Logger) error {
+	var (
+		rrdfile       string
+		host, port    string
+		listen        string
+		mfrCutoffProb float64
+	)
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.StringVar(&rrdfile, "f", "./rrd.db", "Path to RRD file.")
+	f.StringVar(&host, "host", "localhost", "api host")
+	f.StringVar(&port, "port", "8350", "api port")
+	f.StringVar(&listen, "listen", "localhost:8351", "HTTP listen address")
+	f.Float64Var(&mfrCutoffProb, "c", 0.95, "MFR cutoff prob")
+	if err := f.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	s := &plotServer{
+		rrdfile:       rrdfile,
+		c:             newFeesimClient(host, port),
+		mfrCutoffProb: mfrCutoffProb,
+		logger:        logger,
+	}
+	logger.Printf("Serving plots on %s", listen)
+	return http.ListenAndServe(listen, s)
+}
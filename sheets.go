@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenURL  = "https://oauth2.googleapis.com/token"
+	defaultSheetsURL = "https://sheets.googleapis.com"
+	sheetsScope      = "https://www.googleapis.com/auth/spreadsheets"
+)
+
+// sheetsSink uploads worksheets using the Google Sheets v4 API, authorizing
+// as a service account.
+type sheetsSink struct {
+	spreadsheetID string
+	email         string
+	key           *rsa.PrivateKey
+	tokenURL      string
+	sheetsURL     string
+	client        *http.Client // no timeout; each try is limited by the retry policy
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// newSheetsSink reads the service account credentials from authfile. If
+// tokenURL is empty, the token_uri from the credentials is used.
+func newSheetsSink(spreadsheetID, authfile, tokenURL, sheetsURL string) (*sheetsSink, error) {
+	var sa serviceAccount
+	if b, err := ioutil.ReadFile(authfile); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(b, &sa); err != nil {
+		return nil, fmt.Errorf("Parsing auth file: %v", err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, errors.New("Auth file missing client_email or private_key.")
+	}
+	key, err := parsePrivateKey([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenURL == "" {
+		tokenURL = sa.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = defaultTokenURL
+	}
+	if sheetsURL == "" {
+		sheetsURL = defaultSheetsURL
+	}
+	s := &sheetsSink{
+		spreadsheetID: spreadsheetID,
+		email:         sa.ClientEmail,
+		key:           key,
+		tokenURL:      tokenURL,
+		sheetsURL:     strings.TrimRight(sheetsURL, "/"),
+		client:        &http.Client{},
+	}
+	return s, nil
+}
+
+func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("Invalid private key: no PEM block.")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if rk, ok := k.(*rsa.PrivateKey); ok {
+			return rk, nil
+		}
+		return nil, errors.New("Invalid private key: not RSA.")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func (s *sheetsSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	table := parseTable(csv)
+	if len(table) == 0 {
+		return permanent(errors.New("Empty CSV."))
+	}
+	nrows, ncols := len(table), len(table[0])
+
+	sheetID, err := s.sheetID(ctx, worksheet)
+	if err != nil {
+		return err
+	}
+
+	resize := map[string]interface{}{
+		"requests": []interface{}{
+			map[string]interface{}{
+				"updateSheetProperties": map[string]interface{}{
+					"properties": map[string]interface{}{
+						"sheetId": sheetID,
+						"gridProperties": map[string]interface{}{
+							"rowCount":    nrows,
+							"columnCount": ncols,
+						},
+					},
+					"fields": "gridProperties(rowCount,columnCount)",
+				},
+			},
+		},
+	}
+	if err := s.do(ctx, "POST", s.spreadsheetURL()+":batchUpdate", resize, nil); err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{
+		"valueInputOption": "USER_ENTERED",
+		"data": []interface{}{
+			map[string]interface{}{
+				"range":  sheetRange(worksheet, nrows, ncols),
+				"values": table,
+			},
+		},
+	}
+	return s.do(ctx, "POST", s.spreadsheetURL()+"/values:batchUpdate", values, nil)
+}
+
+// sheetID returns the numeric ID of the named worksheet.
+func (s *sheetsSink) sheetID(ctx context.Context, worksheet string) (int64, error) {
+	var r struct {
+		Sheets []struct {
+			Properties struct {
+				SheetID int64  `json:"sheetId"`
+				Title   string `json:"title"`
+			} `json:"properties"`
+		} `json:"sheets"`
+	}
+	u := s.spreadsheetURL() + "?fields=" + url.QueryEscape("sheets.properties(sheetId,title)")
+	if err := s.do(ctx, "GET", u, nil, &r); err != nil {
+		return 0, err
+	}
+	for _, sh := range r.Sheets {
+		if sh.Properties.Title == worksheet {
+			return sh.Properties.SheetID, nil
+		}
+	}
+	return 0, permanent(fmt.Errorf("Worksheet %s not found.", worksheet))
+}
+
+func (s *sheetsSink) spreadsheetURL() string {
+	return s.sheetsURL + "/v4/spreadsheets/" + url.PathEscape(s.spreadsheetID)
+}
+
+// do sends an authorized JSON request, decoding the response into out if it
+// is non-nil.
+func (s *sheetsSink) do(ctx context.Context, method, u string, in, out interface{}) error {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The token was rejected, so get a new one on the next try.
+		s.forgetToken(token)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode,
+			fmt.Errorf("Sheets API %s %s: %s: %s", method, u, resp.Status, bytes.TrimSpace(b)))
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+// statusError marks err, from a response with the given status, as
+// permanent if it is a client error other than an expired or revoked
+// token, a timeout or a rate limit.
+func statusError(status int, err error) error {
+	switch status {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return err
+	}
+	if status >= 400 && status < 500 {
+		return permanent(err)
+	}
+	return err
+}
+
+// forgetToken clears the cached access token if it is still token.
+func (s *sheetsSink) forgetToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+		s.expiry = time.Time{}
+	}
+}
+
+// accessToken returns a cached OAuth2 access token, fetching a new one with
+// a signed JWT assertion if it is missing or about to expire.
+func (s *sheetsSink) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expiry) {
+		return s.token, nil
+	}
+
+	assertion, err := s.signJWT(time.Now())
+	if err != nil {
+		return "", permanent(err)
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp.StatusCode,
+			fmt.Errorf("Token request: %s: %s", resp.Status, bytes.TrimSpace(b)))
+	}
+	var r struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return "", err
+	}
+	if r.AccessToken == "" {
+		return "", errors.New("Token request: no access_token in response.")
+	}
+	s.token = r.AccessToken
+	// Refresh a minute early to allow for clock skew.
+	s.expiry = time.Now().Add(time.Duration(r.ExpiresIn-60) * time.Second)
+	return s.token, nil
+}
+
+func (s *sheetsSink) signJWT(now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	claims := map[string]interface{}{
+		"iss":   s.email,
+		"scope": sheetsScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	hb, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(hb) + "." + enc.EncodeToString(cb)
+	h := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// parseTable splits csv into cells the same way putsheet does, i.e. on
+// newlines and commas without quoting.
+func parseTable(csv []byte) [][]string {
+	var table [][]string
+	for _, line := range strings.Split(strings.TrimRight(string(csv), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		table = append(table, strings.Split(line, ","))
+	}
+	return table
+}
+
+// sheetRange returns the A1 range covering nrows x ncols in worksheet.
+func sheetRange(worksheet string, nrows, ncols int) string {
+	title := "'" + strings.Replace(worksheet, "'", "''", -1) + "'"
+	return fmt.Sprintf("%s!A1:%s%d", title, columnName(ncols), nrows)
+}
+
+// columnName returns the A1 column letters for the 1-based column n.
+func columnName(n int) string {
+	var b []byte
+	for n > 0 {
+		n--
+		b = append([]byte{byte('A' + n%26)}, b...)
+		n /= 26
+	}
+	return string(b)
+}
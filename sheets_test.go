@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSheets is a token endpoint and Sheets API server with one worksheet,
+// "1m".
+type fakeSheets struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PublicKey
+
+	mu       sync.Mutex
+	tokens   int                 // tokens issued
+	reject   bool                // reject the next authorized request
+	requests map[string][][]byte // bodies by method and path
+}
+
+func newFakeSheets(t *testing.T, key *rsa.PublicKey) *fakeSheets {
+	f := &fakeSheets{t: t, key: key, requests: make(map[string][][]byte)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSheets) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.checkJWT(r.PostForm.Get("assertion")); err != nil {
+			f.t.Errorf("Bad assertion: %v", err)
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		f.tokens++
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": 3600}`, f.tokens)
+		return
+	}
+
+	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token%d", f.tokens) || f.reject {
+		f.reject = false
+		http.Error(w, `{"error": "unauthenticated"}`, http.StatusUnauthorized)
+		return
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	key := r.Method + " " + r.URL.Path
+	f.requests[key] = append(f.requests[key], b)
+	switch key {
+	case "GET /v4/spreadsheets/ID":
+		fmt.Fprint(w, `{"sheets": [{"properties": {"sheetId": 7, "title": "1m"}}]}`)
+	case "POST /v4/spreadsheets/ID:batchUpdate", "POST /v4/spreadsheets/ID/values:batchUpdate":
+		fmt.Fprint(w, `{}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// checkJWT verifies the signature and claims of a JWT assertion.
+func (f *fakeSheets) checkJWT(assertion string) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%d parts", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, h[:], sig); err != nil {
+		return err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		Iss, Scope, Aud string
+		Iat, Exp        int64
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return err
+	}
+	if claims.Iss != "plotter@example.com" || claims.Scope != sheetsScope ||
+		claims.Aud != f.URL+"/token" || claims.Exp-claims.Iat != 3600 {
+		return fmt.Errorf("claims %+v", claims)
+	}
+	return nil
+}
+
+func (f *fakeSheets) issued() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tokens
+}
+
+func (f *fakeSheets) bodies(key string) [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[key]
+}
+
+func newTestSheetsSink(t *testing.T) (*sheetsSink, *fakeSheets) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newFakeSheets(t, &key.PublicKey)
+	auth, _ := json.Marshal(map[string]string{
+		"client_email": "plotter@example.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	authfile := filepath.Join(t.TempDir(), "auth.json")
+	if err := ioutil.WriteFile(authfile, auth, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSheetsSink("ID", authfile, api.URL+"/token", api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, api
+}
+
+func TestSheetsSink(t *testing.T) {
+	s, api := newTestSheetsSink(t)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := s.Put(ctx, "1m", []byte("time,a\n60,1\n120,\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := api.issued(); n != 1 {
+		t.Errorf("%d tokens fetched, want 1.", n)
+	}
+
+	var resize struct {
+		Requests []struct {
+			UpdateSheetProperties struct {
+				Properties struct {
+					SheetID        int64
+					GridProperties struct{ RowCount, ColumnCount int }
+				}
+			}
+		}
+	}
+	bodies := api.bodies("POST /v4/spreadsheets/ID:batchUpdate")
+	if len(bodies) != 2 {
+		t.Fatalf("%d resize requests, want 2.", len(bodies))
+	}
+	if err := json.Unmarshal(bodies[0], &resize); err != nil {
+		t.Fatal(err)
+	}
+	p := resize.Requests[0].UpdateSheetProperties.Properties
+	if p.SheetID != 7 || p.GridProperties.RowCount != 3 || p.GridProperties.ColumnCount != 2 {
+		t.Errorf("Bad resize request %s.", bodies[0])
+	}
+
+	var values struct {
+		ValueInputOption string
+		Data             []struct {
+			Range  string
+			Values [][]string
+		}
+	}
+	bodies = api.bodies("POST /v4/spreadsheets/ID/values:batchUpdate")
+	if len(bodies) != 2 {
+		t.Fatalf("%d values requests, want 2.", len(bodies))
+	}
+	if err := json.Unmarshal(bodies[0], &values); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"time", "a"}, {"60", "1"}, {"120", ""}}
+	if values.ValueInputOption != "USER_ENTERED" || len(values.Data) != 1 ||
+		values.Data[0].Range != "'1m'!A1:B3" || !reflect.DeepEqual(values.Data[0].Values, want) {
+		t.Errorf("Bad values request %s.", bodies[0])
+	}
+
+	if err := s.Put(ctx, "3h", []byte("time,a\n")); err == nil || !isPermanent(err) {
+		t.Errorf("Got error %v for a missing worksheet, want a permanent error.", err)
+	}
+}
+
+func TestSheetsSinkRejectedToken(t *testing.T) {
+	s, api := newTestSheetsSink(t)
+	ctx := context.Background()
+	if err := s.Put(ctx, "1m", []byte("time\n60\n")); err != nil {
+		t.Fatal(err)
+	}
+	api.mu.Lock()
+	api.reject = true
+	api.mu.Unlock()
+	err := s.Put(ctx, "1m", []byte("time\n60\n"))
+	if err == nil || isPermanent(err) {
+		t.Fatalf("Got error %v for a rejected token, want a retryable error.", err)
+	}
+	if err := s.Put(ctx, "1m", []byte("time\n60\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.issued(); n != 2 {
+		t.Errorf("%d tokens fetched, want 2.", n)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sink publishes a CSV table to a named worksheet.
+type Sink interface {
+	Put(ctx context.Context, worksheet string, csv []byte) error
+}
+
+// sinkConfig holds the global options used to construct sinks.
+type sinkConfig struct {
+	bin         string
+	spreadsheet string
+	auth        string
+	tokenURL    string
+	sheetsURL   string
+	retry       retryPolicy
+	spool       string // spool directory; no spooling if empty
+	dedup       string // upload hash file; no deduplication if empty
+}
+
+// newSink returns the Sink described by spec, which has the form KIND or
+// KIND:ARG, retrying failed Puts according to the global retry policy.
+func newSink(spec string, cfg sinkConfig) (Sink, error) {
+	s, err := newBaseSink(spec, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return uploadSink(spec, s, cfg, cfg.retry)
+}
+
+// uploadSink wraps the sink returned by newBaseSink for spec with retries,
+// metrics and, if set in cfg, spooling of failed Puts and skipping of
+// unchanged payloads.
+func uploadSink(spec string, s Sink, cfg sinkConfig, policy retryPolicy) (Sink, error) {
+	s = &meteredSink{&retrySink{s, policy}}
+	if cfg.spool != "" {
+		s = &spoolSink{s, openSpool(cfg.spool, spec)}
+	}
+	if cfg.dedup != "" {
+		store, err := openHashStore(cfg.dedup)
+		if err != nil {
+			return nil, err
+		}
+		s = &dedupSink{s, sinkTarget(spec, cfg), store}
+	}
+	return s, nil
+}
+
+// sinkTarget identifies where the sink for spec puts worksheets. The spec of
+// a sheet sink doesn't include the spreadsheet, so it is appended.
+func sinkTarget(spec string, cfg sinkConfig) string {
+	switch spec {
+	case "putsheet", "sheets":
+		return spec + " " + cfg.spreadsheet
+	}
+	return spec
+}
+
+func newBaseSink(spec string, cfg sinkConfig) (Sink, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "putsheet":
+		if cfg.bin == "" || cfg.spreadsheet == "" || cfg.auth == "" {
+			return nil, errors.New("putsheet sink needs -b, -s and -a.")
+		}
+		return &putsheetSink{bin: cfg.bin, spreadsheet: cfg.spreadsheet, auth: cfg.auth}, nil
+	case "sheets":
+		if cfg.spreadsheet == "" || cfg.auth == "" {
+			return nil, errors.New("sheets sink needs -s and -a.")
+		}
+		return newSheetsSink(cfg.spreadsheet, cfg.auth, cfg.tokenURL, cfg.sheetsURL)
+	case "dir":
+		if arg == "" {
+			return nil, errors.New("dir sink needs a directory, e.g. dir:/var/lib/feesim-plot.")
+		}
+		return newDirSink(arg)
+	default:
+		return nil, fmt.Errorf("Invalid sink %s.", spec)
+	}
+}
+
+// meteredSink records upload durations.
+type meteredSink struct {
+	Sink
+}
+
+func (s *meteredSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	defer observeSince(uploadDuration, worksheet, time.Now())
+	return s.Sink.Put(ctx, worksheet, csv)
+}
+
+type worksheet struct {
+	name string
+	csv  []byte
+}
+
+// putAll puts the worksheets concurrently, returning the last error
+// encountered, if any.
+func putAll(ctx context.Context, s Sink, sheets ...worksheet) error {
+	errc := make(chan error)
+	for _, w := range sheets {
+		go func(w worksheet) { errc <- s.Put(ctx, w.name, w.csv) }(w)
+	}
+
+	var errGlobal error
+	for range sheets {
+		if err := <-errc; err != nil {
+			errGlobal = err
+		}
+	}
+	return errGlobal
+}
+
+// dirSink writes each worksheet to <dir>/<worksheet>.csv.
+type dirSink struct {
+	dir string
+}
+
+func newDirSink(dir string) (*dirSink, error) {
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory.", dir)
+	}
+	return &dirSink{dir: dir}, nil
+}
+
+func (s *dirSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if worksheet == "" || strings.ContainsAny(worksheet, `/\`) {
+		return permanent(fmt.Errorf("Invalid worksheet name %q.", worksheet))
+	}
+	return writeFileAtomic(filepath.Join(s.dir, worksheet+".csv"), csv)
+}
+
+// writeFileAtomic writes data to a temp file in the same directory as
+// filename, then renames it into place, so that readers never see a partial
+// file.
+func writeFileAtomic(filename string, data []byte) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshot holds the raw feesim API responses used by the profile, mining
+// and scores plots, so that the plots can be rebuilt later.
+type snapshot struct {
+	Time        time.Time    `json:"time"`
+	Host        string       `json:"host"`
+	Port        string       `json:"port"`
+	TxRate      snapshotCall `json:"txrate"`
+	CapRate     snapshotCall `json:"caprate"`
+	MempoolSize snapshotCall `json:"mempoolsize"`
+	EstimateFee snapshotCall `json:"estimatefee"`
+	BlockSource snapshotCall `json:"blocksource"`
+	Scores      snapshotCall `json:"scores"`
+}
+
+// snapshotCall is the response to an API call with argument N, or the
+// error it failed with.
+type snapshotCall struct {
+	N      int             `json:"n,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+func (c *snapshotCall) record(n int, result interface{}, err error) {
+	c.N = n
+	if err == nil {
+		c.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+}
+
+func (c *snapshotCall) recordFloats(n int, result map[string][]float64, err error) {
+	r := make(map[string]jsonFloats, len(result))
+	for k, v := range result {
+		r[k] = v
+	}
+	c.record(n, r, err)
+}
+
+// decode decodes the response to the named call into v, returning the
+// recorded error if the call failed.
+func (c *snapshotCall) decode(name string, n int, v interface{}) error {
+	if c.Error != "" {
+		return errors.New(c.Error)
+	}
+	if c.Result == nil {
+		return fmt.Errorf("Snapshot has no %s.", name)
+	}
+	if c.N != n {
+		return fmt.Errorf("Snapshot has %s for n=%d, not %d.", name, c.N, n)
+	}
+	if err := json.Unmarshal(c.Result, v); err != nil {
+		return fmt.Errorf("Snapshot %s: %v", name, err)
+	}
+	return nil
+}
+
+func (c *snapshotCall) decodeFloats(name string, n int) (map[string][]float64, error) {
+	var r map[string]jsonFloats
+	if err := c.decode(name, n, &r); err != nil {
+		return nil, err
+	}
+	result := make(map[string][]float64, len(r))
+	for k, v := range r {
+		result[k] = v
+	}
+	return result, nil
+}
+
+// takeSnapshot makes the API calls of the profile, mining and scores plots,
+// with the numbers of profile points in opts. Failed calls are recorded in
+// the snapshot, and reported in the error.
+func takeSnapshot(ctx context.Context, c feesimAPI, opts profileOptions) (*snapshot, error) {
+	opts = opts.withDefaults()
+	s := &snapshot{Time: time.Now().UTC()}
+	txrate, err := c.TxRate(ctx, opts.TxRatePoints)
+	s.TxRate.recordFloats(opts.TxRatePoints, txrate, err)
+	caprate, err := c.CapRate(ctx, opts.CapRatePoints)
+	s.CapRate.recordFloats(opts.CapRatePoints, caprate, err)
+	mempool, err := c.MempoolSize(ctx, opts.MempoolPoints)
+	s.MempoolSize.recordFloats(opts.MempoolPoints, mempool, err)
+	estimate, err := c.EstimateFee(ctx, 0)
+	s.EstimateFee.record(0, estimate, err)
+	blksrc, err := c.BlockSource(ctx)
+	s.BlockSource.record(0, blksrc, err)
+	scores, err := c.Scores(ctx)
+	s.Scores.recordFloats(0, scores, err)
+
+	var failed []string
+	calls := []*snapshotCall{&s.TxRate, &s.CapRate, &s.MempoolSize, &s.EstimateFee, &s.BlockSource, &s.Scores}
+	names := []string{"txrate", "caprate", "mempoolsize", "estimatefee", "blocksource", "scores"}
+	for i, call := range calls {
+		if call.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", names[i], call.Error))
+		}
+	}
+	if len(failed) > 0 {
+		return s, fmt.Errorf("Snapshot incomplete: %s", strings.Join(failed, "; "))
+	}
+	return s, nil
+}
+
+// snapshotAPI replays the API responses in a snapshot.
+type snapshotAPI struct {
+	s *snapshot
+}
+
+func readSnapshot(filename string) (*snapshotAPI, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := new(snapshot)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("Reading snapshot %s: %v", filename, err)
+	}
+	return &snapshotAPI{s}, nil
+}
+
+func (a *snapshotAPI) Scores(ctx context.Context) (map[string][]float64, error) {
+	return a.s.Scores.decodeFloats("scores", 0)
+}
+
+func (a *snapshotAPI) BlockSource(ctx context.Context) (map[string]interface{}, error) {
+	var r map[string]interface{}
+	if err := a.s.BlockSource.decode("blocksource", 0, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (a *snapshotAPI) TxRate(ctx context.Context, n int) (map[string][]float64, error) {
+	return a.s.TxRate.decodeFloats("txrate", n)
+}
+
+func (a *snapshotAPI) CapRate(ctx context.Context, n int) (map[string][]float64, error) {
+	return a.s.CapRate.decodeFloats("caprate", n)
+}
+
+func (a *snapshotAPI) MempoolSize(ctx context.Context, n int) (map[string][]float64, error) {
+	return a.s.MempoolSize.decodeFloats("mempoolsize", n)
+}
+
+func (a *snapshotAPI) EstimateFee(ctx context.Context, n int) (interface{}, error) {
+	var r interface{}
+	if err := a.s.EstimateFee.decode("estimatefee", n, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// dataTime returns the time of the data from c, which is the time of the
+// snapshot when replaying one, or else now.
+func dataTime(c feesimAPI) time.Time {
+	if a, ok := c.(*snapshotAPI); ok {
+		return a.s.Time
+	}
+	return time.Now()
+}
+
+// apiSource returns the snapshot in replay if it is set, or else the API at
+// host and port.
+func apiSource(host, port, replay string) (feesimAPI, error) {
+	if replay != "" {
+		return readSnapshot(replay)
+	}
+	return newFeesimClient(host, port), nil
+}
+
+// jsonFloats is a []float64 which encodes NaN and infinities, which JSON
+// can't represent, as null, and decodes null as NaN.
+type jsonFloats []float64
+
+func (f jsonFloats) MarshalJSON() ([]byte, error) {
+	if f == nil {
+		return []byte("null"), nil
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte('[')
+	for i, v := range f {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			buf.WriteString("null")
+		} else {
+			b, _ := json.Marshal(v)
+			buf.Write(b)
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+func (f *jsonFloats) UnmarshalJSON(b []byte) error {
+	var v []*float64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v == nil {
+		*f = nil
+		return nil
+	}
+	*f = make(jsonFloats, len(v))
+	for i, p := range v {
+		if p == nil {
+			(*f)[i] = math.NaN()
+		} else {
+			(*f)[i] = *p
+		}
+	}
+	return nil
+}
+
+func doSnapshot(ctx context.Context, args []string) error {
+	var (
+		host, port string
+		dir        string
+		opts       profileOptions
+	)
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.StringVar(&host, "host", "localhost", "api host")
+	f.StringVar(&port, "port", "8350", "api port")
+	f.StringVar(&dir, "o", ".", "Output directory.")
+	profilePointFlags(f, &opts)
+	if err := f.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	s, snapErr := takeSnapshot(ctx, newFeesimClient(host, port), opts)
+	s.Host, s.Port = host, port
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, "feesim-snapshot-"+s.Time.Format("20060102T150405Z")+".json")
+	if err := writeFileAtomic(filename, append(b, '\n')); err != nil {
+		return err
+	}
+	fmt.Println(filename)
+	return snapErr
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spool keeps the newest payload of each worksheet that failed to upload to
+// a sink, in <root>/<sink spec>/<worksheet>.csv, so that it can be replayed
+// once the sink recovers. Path components are escaped.
+type spool struct {
+	spec string
+	dir  string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var spools = struct {
+	sync.Mutex
+	m map[string]*spool
+}{m: make(map[string]*spool)}
+
+// openSpool returns the spool for spec under root. Spools are shared, so
+// that uploads and replays of a worksheet don't interleave.
+func openSpool(root, spec string) *spool {
+	dir := filepath.Join(root, spoolEscape(spec))
+	spools.Lock()
+	defer spools.Unlock()
+	if s, ok := spools.m[dir]; ok {
+		return s
+	}
+	s := &spool{spec: spec, dir: dir, locks: make(map[string]*sync.Mutex)}
+	spools.m[dir] = s
+	return s
+}
+
+// spoolEscape escapes name for use as a file name.
+func spoolEscape(name string) string {
+	name = url.PathEscape(name)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// lock locks the worksheet, returning the function which unlocks it.
+func (s *spool) lock(worksheet string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[worksheet]
+	if !ok {
+		l = new(sync.Mutex)
+		s.locks[worksheet] = l
+	}
+	s.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (s *spool) filename(worksheet string) string {
+	return filepath.Join(s.dir, spoolEscape(worksheet)+".csv")
+}
+
+func (s *spool) save(worksheet string, csv []byte) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.filename(worksheet), csv)
+}
+
+func (s *spool) remove(worksheet string) error {
+	if err := os.Remove(s.filename(worksheet)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+type spoolEntry struct {
+	worksheet string
+	size      int64
+	spooled   time.Time
+}
+
+// entries returns the spooled worksheets, oldest first.
+func (s *spool) entries() ([]spoolEntry, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []spoolEntry
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		worksheet, err := url.PathUnescape(strings.TrimSuffix(name, ".csv"))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, spoolEntry{worksheet, fi.Size(), fi.ModTime()})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].spooled.Before(entries[j].spooled) })
+	return entries, nil
+}
+
+// replay puts the spooled payload of the worksheet, if any, to sink,
+// removing it once put.
+func (s *spool) replay(ctx context.Context, sink Sink, worksheet string) error {
+	unlock := s.lock(worksheet)
+	defer unlock()
+	csv, err := ioutil.ReadFile(s.filename(worksheet))
+	if os.IsNotExist(err) {
+		// Superseded by a successful upload.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := sink.Put(ctx, worksheet, csv); err != nil {
+		return err
+	}
+	spoolReplayed.Inc(worksheet)
+	return s.remove(worksheet)
+}
+
+// drain replays the spooled worksheets, oldest first, stopping at the first
+// failure, since the sink has likely not recovered. It returns the number of
+// worksheets replayed.
+func (s *spool) drain(ctx context.Context, sink Sink) (int, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range entries {
+		if err := s.replay(ctx, sink, e.worksheet); err != nil {
+			return i, fmt.Errorf("Replaying %s: %v", e.worksheet, err)
+		}
+	}
+	return len(entries), nil
+}
+
+// spoolSpecs returns the sink specs with a spool under root.
+func spoolSpecs(root string) ([]string, error) {
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var specs []string
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		if spec, err := url.PathUnescape(fi.Name()); err == nil {
+			specs = append(specs, spec)
+		}
+	}
+	return specs, nil
+}
+
+// spoolSink spools the payloads of Puts which fail with an error that isn't
+// permanent. A successful Put supersedes the spooled payload.
+type spoolSink struct {
+	Sink
+	spool *spool
+}
+
+func (s *spoolSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	unlock := s.spool.lock(worksheet)
+	defer unlock()
+	err := s.Sink.Put(ctx, worksheet, csv)
+	if err == nil {
+		return s.spool.remove(worksheet)
+	}
+	if isPermanent(err) {
+		return err
+	}
+	if serr := s.spool.save(worksheet, csv); serr != nil {
+		return fmt.Errorf("%v (spooling failed: %v)", err, serr)
+	}
+	spooledUploads.Inc(worksheet)
+	return fmt.Errorf("%v (spooled)", err)
+}
+
+// drainSpools replays the spooled worksheets of every sink under root each
+// interval, until ctx is done. sink returns the Sink used to replay to a
+// sink spec.
+func drainSpools(ctx context.Context, root string, interval time.Duration, sink func(spec string) (Sink, error), logger *Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		specs, err := spoolSpecs(root)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf("[ERROR] Reading spool: %v", err)
+		}
+		for _, spec := range specs {
+			s, err := sink(spec)
+			if err != nil {
+				logger.Printf("[ERROR] Draining spool of %s: %v", spec, err)
+				continue
+			}
+			n, err := openSpool(root, spec).drain(withLogger(ctx, logger), s)
+			if n > 0 {
+				logger.Printf("Replayed %d spooled worksheet(s) to %s", n, spec)
+			}
+			if err != nil {
+				logger.With(logFields{"sink": spec, "error": err}).
+					Printf("[ERROR] Draining spool of %s: %v", spec, err)
+			}
+		}
+	}
+}
+
+func doSpool(ctx context.Context, args []string, root string, sinkcfg sinkConfig) error {
+	if root == "" {
+		return errors.New("Need to specify spool directory with -spool.")
+	}
+	if len(args) < 2 {
+		return errors.New("Insufficient args.")
+	}
+	var worksheet string
+	f := flag.NewFlagSet(args[0]+" "+args[1], flag.ExitOnError)
+	f.StringVar(&worksheet, "w", "", "Only flush this worksheet.")
+	if err := f.Parse(args[2:]); err != nil {
+		return err
+	}
+	specs, err := spoolSpecs(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch args[1] {
+	case "list":
+		for _, spec := range specs {
+			entries, err := openSpool(root, spec).entries()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				fmt.Printf("%s\t%s\t%d\t%s\n", spec, e.worksheet, e.size, e.spooled.UTC().Format(time.RFC3339))
+			}
+		}
+		return nil
+	case "flush":
+		var errGlobal error
+		for _, spec := range specs {
+			base, err := newBaseSink(spec, sinkcfg)
+			if err != nil {
+				return err
+			}
+			sink := &retrySink{base, sinkcfg.retry}
+			sp := openSpool(root, spec)
+			entries, err := sp.entries()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if worksheet != "" && e.worksheet != worksheet {
+					continue
+				}
+				if err := sp.replay(ctx, sink, e.worksheet); err != nil {
+					errGlobal = fmt.Errorf("Flushing %s to %s: %v", e.worksheet, spec, err)
+					fmt.Fprintln(os.Stderr, errGlobal)
+					continue
+				}
+				fmt.Printf("Flushed %s to %s\n", e.worksheet, spec)
+			}
+		}
+		return errGlobal
+	default:
+		return fmt.Errorf("Invalid spool command %s.", args[1])
+	}
+}
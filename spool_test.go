@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spooled returns the worksheets in sp, oldest first, with their payloads.
+func spooled(t *testing.T, sp *spool) ([]string, map[string]string) {
+	t.Helper()
+	entries, err := sp.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var worksheets []string
+	payloads := make(map[string]string)
+	for _, e := range entries {
+		b, err := ioutil.ReadFile(sp.filename(e.worksheet))
+		if err != nil {
+			t.Fatal(err)
+		}
+		worksheets = append(worksheets, e.worksheet)
+		payloads[e.worksheet] = string(b)
+	}
+	return worksheets, payloads
+}
+
+// age sets the modification time of the spooled worksheet to d ago.
+func age(t *testing.T, sp *spool, worksheet string, d time.Duration) {
+	t.Helper()
+	mtime := time.Now().Add(-d)
+	if err := os.Chtimes(sp.filename(worksheet), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolSink(t *testing.T) {
+	root := t.TempDir()
+	rs := newRecordingSink()
+	sp := openSpool(root, "dir:/plots")
+	s := &spoolSink{rs, sp}
+	ctx := context.Background()
+
+	rs.err = errors.New("Sink down.")
+	for _, csv := range []string{"old\n", "new\n"} {
+		if err := s.Put(ctx, "1m", []byte(csv)); err == nil || !strings.HasSuffix(err.Error(), "(spooled)") {
+			t.Fatalf("Got error %v, want spooled error.", err)
+		}
+	}
+	if err := s.Put(ctx, ".hidden/x", []byte("h\n")); err == nil {
+		t.Fatal("No error from failed Put.")
+	}
+	rs.err = permanent(errors.New("Worksheet not found."))
+	if err := s.Put(ctx, "3h", []byte("p\n")); err != rs.err {
+		t.Fatalf("Got error %v, want %v.", err, rs.err)
+	}
+	worksheets, payloads := spooled(t, sp)
+	want := map[string]string{"1m": "new\n", ".hidden/x": "h\n"}
+	if len(worksheets) != 2 || !reflect.DeepEqual(payloads, want) {
+		t.Fatalf("Spooled %v, want %v.", payloads, want)
+	}
+
+	// The spec and worksheet are escaped, so the spool is one directory of
+	// files which aren't hidden.
+	files, _ := filepath.Glob(filepath.Join(root, "*", "*"))
+	for _, f := range files {
+		if rel, _ := filepath.Rel(root, f); strings.Count(rel, string(filepath.Separator)) != 1 ||
+			strings.HasPrefix(filepath.Base(f), ".") {
+			t.Errorf("Bad spool file %s.", rel)
+		}
+	}
+	if specs, err := spoolSpecs(root); err != nil || !reflect.DeepEqual(specs, []string{"dir:/plots"}) {
+		t.Errorf("Got specs %v, %v, want [dir:/plots].", specs, err)
+	}
+
+	// A successful Put supersedes the spooled payload.
+	rs.err = nil
+	if err := s.Put(ctx, "1m", []byte("newer\n")); err != nil {
+		t.Fatal(err)
+	}
+	if worksheets, _ := spooled(t, sp); !reflect.DeepEqual(worksheets, []string{".hidden/x"}) {
+		t.Errorf("Spooled %v after successful Put, want [.hidden/x].", worksheets)
+	}
+}
+
+// failingSink fails Puts of the worksheet fail.
+type failingSink struct {
+	*recordingSink
+	fail string
+}
+
+func (s *failingSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	if worksheet == s.fail {
+		return errors.New("Sink down.")
+	}
+	return s.recordingSink.Put(ctx, worksheet, csv)
+}
+
+func TestSpoolDrain(t *testing.T) {
+	sp := openSpool(t.TempDir(), "putsheet")
+	for i, w := range []string{"1m", "30m", "3h"} {
+		if err := sp.save(w, []byte(w+"\n")); err != nil {
+			t.Fatal(err)
+		}
+		age(t, sp, w, time.Duration(3-i)*time.Minute)
+	}
+
+	rs := newRecordingSink()
+	n, err := sp.drain(context.Background(), &failingSink{rs, "30m"})
+	if n != 1 || err == nil || !strings.Contains(err.Error(), "30m") {
+		t.Fatalf("Got (%d, %v), want 1 replayed and an error for 30m.", n, err)
+	}
+	if csv, _ := rs.get("1m"); string(csv) != "1m\n" || rs.puts != 1 {
+		t.Errorf("Got %d puts and 1m %q, want the oldest worksheet only.", rs.puts, csv)
+	}
+	if worksheets, _ := spooled(t, sp); !reflect.DeepEqual(worksheets, []string{"30m", "3h"}) {
+		t.Errorf("Spooled %v after failed drain, want [30m 3h].", worksheets)
+	}
+
+	if n, err := sp.drain(context.Background(), rs); n != 2 || err != nil {
+		t.Fatalf("Got (%d, %v), want 2 replayed.", n, err)
+	}
+	if worksheets, _ := spooled(t, sp); len(worksheets) != 0 {
+		t.Errorf("Spooled %v after drain, want none.", worksheets)
+	}
+}
+
+// blockingSink blocks Puts until release is closed.
+type blockingSink struct {
+	*recordingSink
+	started, release chan struct{}
+}
+
+func (s *blockingSink) Put(ctx context.Context, worksheet string, csv []byte) error {
+	close(s.started)
+	<-s.release
+	return s.recordingSink.Put(ctx, worksheet, csv)
+}
+
+// TestSpoolLock checks that a replay waits for an upload of the same
+// worksheet, which supersedes the spooled payload.
+func TestSpoolLock(t *testing.T) {
+	sp := openSpool(t.TempDir(), "putsheet")
+	if err := sp.save("1m", []byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+	bs := &blockingSink{newRecordingSink(), make(chan struct{}), make(chan struct{})}
+	putc := make(chan error)
+	go func() { putc <- (&spoolSink{bs, sp}).Put(context.Background(), "1m", []byte("new\n")) }()
+	<-bs.started
+
+	replayed := newRecordingSink()
+	replayc := make(chan error)
+	go func() { replayc <- sp.replay(context.Background(), replayed, "1m") }()
+	select {
+	case err := <-replayc:
+		t.Fatalf("Replay returned %v during an upload.", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(bs.release)
+	if err := <-putc; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-replayc; err != nil {
+		t.Fatal(err)
+	}
+	if replayed.puts != 0 {
+		t.Error("Superseded payload replayed.")
+	}
+}
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	outc := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		outc <- b
+	}()
+	f()
+	w.Close()
+	return string(<-outc)
+}
+
+func TestDoSpool(t *testing.T) {
+	root, out := t.TempDir(), t.TempDir()
+	spec := "dir:" + out
+	sp := openSpool(root, spec)
+	for i, w := range []string{"1m", "3h"} {
+		if err := sp.save(w, []byte(w+"\n")); err != nil {
+			t.Fatal(err)
+		}
+		age(t, sp, w, time.Duration(2-i)*time.Minute)
+	}
+	cfg := sinkConfig{retry: retryPolicy{Attempts: 1}}
+	ctx := context.Background()
+
+	var err error
+	list := captureStdout(t, func() { err = doSpool(ctx, []string{"spool", "list"}, root, cfg) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(list), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], spec+"\t1m\t3\t") || !strings.HasPrefix(lines[1], spec+"\t3h\t3\t") {
+		t.Errorf("Bad spool list:\n%s", list)
+	}
+
+	flush := captureStdout(t, func() { err = doSpool(ctx, []string{"spool", "flush", "-w", "3h"}, root, cfg) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flush != "Flushed 3h to "+spec+"\n" {
+		t.Errorf("Got flush output %q.", flush)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(out, "3h.csv")); err != nil || string(b) != "3h\n" {
+		t.Errorf("Got flushed 3h %q, %v.", b, err)
+	}
+	if worksheets, _ := spooled(t, sp); !reflect.DeepEqual(worksheets, []string{"1m"}) {
+		t.Errorf("Spooled %v after flushing 3h, want [1m].", worksheets)
+	}
+
+	if err := doSpool(ctx, []string{"spool", "purge"}, root, cfg); err == nil {
+		t.Error("No error for an invalid spool command.")
+	}
+}